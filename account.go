@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+var (
+	// accounts to fetch, loaded at start
+	accounts []*account
+)
+
+// account is a publisher account of Performance Horizon
+type account struct {
+	ID          int    `orm:"column(id);pk;auto"`
+	Name        string `orm:"column(name)"`
+	AppKey      string `orm:"column(app_key)"`
+	APIKey      string `orm:"column(api_key)"`
+	PublisherID string `orm:"column(publisher_id)"`
+	Atoken      string `orm:"column(at)"` // advertiser token written to conversions
+	Enabled     int    `orm:"column(enabled)"`
+}
+
+func (a *account) TableName() string {
+	return "affi_publisher_account"
+}
+
+func (a *account) String() string {
+	return a.Name
+}
+
+// flagAccount is the account given by -publisherID and -atoken, used when
+// there is no account in the database. Its credentials are taken from the
+// secrets file, AFFI_APP_KEY and AFFI_API_KEY, or -appKey and -apiKey
+func flagAccount() *account {
+	a := &account{
+		Name:        "default",
+		AppKey:      envOr(envAppKey, appKey),
+		APIKey:      envOr(envAPIKey, apiKey),
+		PublisherID: publisherID,
+		Atoken:      atoken,
+		Enabled:     1,
+	}
+	setCredentials(a)
+	return a
+}
+
+// loadAccounts returns the enabled accounts with the given names, or all of them
+// if names is empty
+func loadAccounts(ctx context.Context, names []string) ([]*account, error) {
+	list, err := findEnabledAccounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range list {
+		setCredentials(a)
+	}
+	if len(list) == 0 {
+		list = []*account{flagAccount()}
+	}
+
+	if len(names) == 0 {
+		return list, nil
+	}
+
+	result := make([]*account, 0, len(names))
+	for _, name := range names {
+		a := findAccount(list, name)
+		if a == nil {
+			return nil, fmt.Errorf("account %s not found", name)
+		}
+		result = append(result, a)
+	}
+
+	return result, nil
+}
+
+func findEnabledAccounts(ctx context.Context) ([]*account, error) {
+	var list []*account
+
+	sql := fmt.Sprintf(`select id, name, app_key, api_key, publisher_id, at, enabled from %s
+    where enabled = 1 order by id`, new(account).TableName())
+	rows, err := dbQuery(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a := &account{}
+		err = rows.Scan(&a.ID, &a.Name, &a.AppKey, &a.APIKey, &a.PublisherID, &a.Atoken, &a.Enabled)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+
+	return list, rows.Err()
+}
+
+func findAccount(list []*account, name string) *account {
+	for _, a := range list {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// accountByID returns the loaded account of id, 0 means the first one
+func accountByID(id int) (*account, error) {
+	if id == 0 {
+		if len(accounts) > 0 {
+			return accounts[0], nil
+		}
+		return flagAccount(), nil
+	}
+
+	for _, a := range accounts {
+		if a.ID == id {
+			return a, nil
+		}
+	}
+
+	return nil, fmt.Errorf("account %d is not loaded", id)
+}
+
+// accountByAtoken returns the loaded account writing the advertiser token, or nil
+func accountByAtoken(at string) *account {
+	for _, a := range accounts {
+		if a.Atoken == at {
+			return a
+		}
+	}
+	return nil
+}
+
+func splitAccountNames(str string) []string {
+	var names []string
+	for _, name := range strings.Split(str, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
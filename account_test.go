@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountJobs(t *testing.T) {
+	assert.Equal(t, []string{"cn", "us"}, splitAccountNames(" cn, ,us"))
+
+	list := []*account{{ID: 1, Name: "cn", Atoken: "at1"}, {ID: 2, Name: "us", Atoken: "at2"}}
+	assert.Equal(t, list[1], findAccount(list, "us"))
+	assert.Nil(t, findAccount(list, "jp"))
+
+	fromTime, _ := strToTimeNoT("2017-02-13 00:00:00")
+	toTime, _ := strToTimeNoT("2017-02-13 23:59:59")
+	jobs, err := sliceAccountJobs(list, fromTime, toTime, 12*time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 4)
+	assert.Equal(t, list[0], jobs[1].account)
+	assert.Equal(t, list[1], jobs[2].account)
+}
+
+func TestLoadAccounts(t *testing.T) {
+	useFakeDB(t, "fakedb")
+
+	// no account in the database, the flags are used
+	list, err := loadAccounts(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "default", list[0].Name)
+
+	_, err = loadAccounts(context.Background(), []string{"us"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	cassetteRecord = "record"
+	cassetteReplay = "replay"
+
+	redacted = "REDACTED"
+)
+
+var (
+	// httpCassette records or replays the responses of HTTPGet and HTTPGetFile, nil means off
+	httpCassette *cassette
+
+	// query parameters and headers never written to a cassette
+	secretParams  = []string{"api_key", "apikey", "app_key", "key", "token", "password", "secret"}
+	secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+)
+
+// cassette keeps request/response pairs in a directory, one json file for
+// each request. Credentials are redacted before a request is written or looked up
+type cassette struct {
+	dir  string
+	mode string
+}
+
+type cassetteRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+}
+
+type cassetteResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+type cassetteEntry struct {
+	Request    cassetteRequest  `json:"request"`
+	Response   cassetteResponse `json:"response"`
+	RecordedAt time.Time        `json:"recorded_at"`
+}
+
+// cassetteMissError is returned in replay mode for a request which was not recorded
+type cassetteMissError struct {
+	URL string
+}
+
+func (e *cassetteMissError) Error() string {
+	return fmt.Sprintf("no cassette for %s", e.URL)
+}
+
+func newCassette(dir, mode string) (*cassette, error) {
+	switch mode {
+	case cassetteRecord:
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	case cassetteReplay:
+		_, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown cassette mode %s", mode)
+	}
+
+	return &cassette{dir: dir, mode: mode}, nil
+}
+
+// doRequest sends req with client, or through the cassette if there is one
+func doRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	if httpCassette != nil {
+		return httpCassette.do(client, req)
+	}
+	return client.Do(req)
+}
+
+func (c *cassette) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	creq := redactRequest(req)
+	file := c.fileName(creq)
+
+	if c.mode == cassetteReplay {
+		return c.load(file, creq, req)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := cassetteEntry{
+		Request: creq,
+		Response: cassetteResponse{
+			StatusCode: res.StatusCode,
+			Header:     redactHeader(res.Header),
+			Body:       []byte(redact(string(body))),
+		},
+		RecordedAt: time.Now(),
+	}
+	err = c.save(file, &entry)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+func (c *cassette) load(file string, creq cassetteRequest, req *http.Request) (*http.Response, error) {
+	var entry cassetteEntry
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, &cassetteMissError{URL: creq.URL}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &entry)
+	if err != nil {
+		return nil, fmt.Errorf("cassette %s: %v", file, err)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Response.StatusCode, http.StatusText(entry.Response.StatusCode)),
+		StatusCode:    entry.Response.StatusCode,
+		Header:        entry.Response.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.Response.Body)),
+		ContentLength: int64(len(entry.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// save writes to a temp file first, so a concurrent replay never reads half a cassette
+func (c *cassette) save(file string, entry *cassetteEntry) error {
+	b, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, ".cassette")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// fileName is the last path segment of the url and a hash of the redacted request,
+// for example conversions-3f0a9c1d2b4e.json
+func (c *cassette) fileName(creq cassetteRequest) string {
+	name := "request"
+	if u, err := url.Parse(creq.URL); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		name = strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path))
+	}
+
+	sum := sha1.Sum([]byte(creq.Method + " " + creq.URL))
+	return filepath.Join(c.dir, fmt.Sprintf("%s-%x.json", name, sum[:6]))
+}
+
+// redactRequest drops the userinfo and secret parameters of the url and secret headers.
+// The query is sorted, so the same request always gets the same cassette
+func redactRequest(req *http.Request) cassetteRequest {
+	u := *req.URL
+	u.User = nil
+
+	query := u.Query()
+	for key := range query {
+		if isSecretParam(key) {
+			query.Set(key, redacted)
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	return cassetteRequest{
+		Method: req.Method,
+		URL:    redact(u.String()),
+		Header: redactHeader(req.Header),
+	}
+}
+
+func redactHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for key, val := range h {
+		out[key] = val
+	}
+	for _, key := range secretHeaders {
+		if out.Get(key) != "" {
+			out.Set(key, redacted)
+		}
+	}
+	return out
+}
+
+func isSecretParam(key string) bool {
+	key = strings.ToLower(key)
+	for _, p := range secretParams {
+		if key == p {
+			return true
+		}
+	}
+	return false
+}
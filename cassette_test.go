@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCassette(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassette")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { httpCassette = nil }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("offset") == "300" {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprintf(w, `{"offset":"%s"}`, r.URL.Query().Get("offset"))
+	}))
+
+	pageURL := strings.Replace(server.URL, "http://", "http://appkey:apikey@", 1) + "/user/publisher/1/conversion.json"
+	config := func(offset string) *RequestConfig {
+		return NewReqeustConfig(map[string]string{"offset": offset, "api_key": "secret"}, nil, 10, nil, nil)
+	}
+
+	httpCassette, err = newCassette(dir, cassetteRecord)
+	assert.NoError(t, err)
+	body, _, err := HTTPGet(pageURL, config("0"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"offset":"0"}`, string(body))
+	_, code, err := HTTPGet(pageURL, config("300"))
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, code)
+
+	// no credentials in the cassettes
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Len(t, files, 2)
+	for _, f := range files {
+		assert.True(t, strings.HasPrefix(filepath.Base(f), "conversion-"))
+		b, _ := ioutil.ReadFile(f)
+		assert.NotContains(t, string(b), "apikey")
+		assert.NotContains(t, string(b), "secret")
+	}
+
+	server.Close()
+	httpCassette, err = newCassette(dir, cassetteReplay)
+	assert.NoError(t, err)
+
+	body, _, err = HTTPGet(pageURL, config("0"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"offset":"0"}`, string(body))
+
+	_, code, err = HTTPGet(pageURL, config("300"))
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	if e, ok := err.(*HTTPError); assert.True(t, ok) {
+		assert.True(t, e.Throttled())
+		assert.Equal(t, int64(7), int64(e.RetryAfter.Seconds()))
+	}
+
+	_, _, err = HTTPGet(pageURL, config("100"))
+	assert.IsType(t, &cassetteMissError{}, err)
+	assert.Equal(t, errClassFatal, classifyError(err))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// checkpoint is the progress of a job, saved after each persisted page so an
+// interrupted run can be resumed where it was
+type checkpoint struct {
+	ID           int       `orm:"column(id);pk;auto" json:"id"`
+	Run          string    `orm:"column(run)" json:"run"`
+	AccountID    int       `orm:"column(account_id)" json:"account_id"`
+	FromTime     time.Time `orm:"column(from_time);type(datetime)" json:"from_time"`
+	ToTime       time.Time `orm:"column(to_time);type(datetime)" json:"to_time"`
+	Offset       int       `orm:"column(offset)" json:"offset"`
+	Limit        int       `orm:"column(page_limit)" json:"limit"`
+	NextPage     string    `orm:"column(next_page)" json:"next_page"`
+	LastConvTime time.Time `orm:"column(last_conv_time);type(datetime)" json:"last_conv_time"`
+	Done         int       `orm:"column(done)" json:"done"` // 0 pending, 1 done
+	CreatedAt    time.Time `orm:"column(created_at);type(timestamp)" json:"created_at"`
+	UpdatedAt    time.Time `orm:"column(updated_at);type(timestamp)" json:"updated_at"`
+}
+
+func (c *checkpoint) TableName() string {
+	return "affi_fetch_checkpoint"
+}
+
+func newCheckpoint(j job) *checkpoint {
+	c := &checkpoint{
+		Run:          j.run,
+		FromTime:     j.from,
+		ToTime:       j.to,
+		Offset:       j.offset,
+		Limit:        j.limit,
+		NextPage:     j.nextPage,
+		LastConvTime: j.from,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}
+	if j.account != nil {
+		c.AccountID = j.account.ID
+	}
+	return c
+}
+
+func (c *checkpoint) insert(ctx context.Context) error {
+	sql := `INSERT INTO %s (run, account_id, from_time, to_time, offset, page_limit, next_page,
+    last_conv_time, done, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?)`
+	sql = fmt.Sprintf(sql, c.TableName())
+
+	res, err := dbExec(ctx, sql, c.Run, c.AccountID, reportTimeStr(c.FromTime), reportTimeStr(c.ToTime),
+		c.Offset, c.Limit, c.NextPage, reportTimeStr(c.LastConvTime), reportTimeStr(c.CreatedAt),
+		reportTimeStr(c.UpdatedAt))
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	c.ID = int(id)
+	return nil
+}
+
+// advanceCheckpoint saves the page j is at to its checkpoint
+func advanceCheckpoint(ctx context.Context, j job, lastConvTime time.Time) error {
+	c := checkpoint{}
+	sql := fmt.Sprintf(`update %s set offset=?, page_limit=?, next_page=?, last_conv_time=?, updated_at=?
+    where id = ?`, c.TableName())
+
+	_, err := dbExec(ctx, sql, j.offset, j.limit, j.nextPage, reportTimeStr(lastConvTime),
+		reportTimeStr(time.Now()), j.checkpoint)
+	return err
+}
+
+func finishCheckpoint(ctx context.Context, j job) error {
+	c := checkpoint{}
+	sql := fmt.Sprintf(`update %s set done=1, updated_at=? where id = ?`, c.TableName())
+
+	_, err := dbExec(ctx, sql, reportTimeStr(time.Now()), j.checkpoint)
+	return err
+}
+
+func (c *checkpoint) job() (job, error) {
+	a, err := accountByID(c.AccountID)
+	if err != nil {
+		return job{}, err
+	}
+
+	j := job{
+		from:       c.FromTime,
+		to:         c.ToTime,
+		offset:     c.Offset,
+		limit:      c.Limit,
+		nextPage:   c.NextPage,
+		account:    a,
+		run:        c.Run,
+		checkpoint: c.ID,
+	}
+	if c.LastConvTime.After(c.FromTime) {
+		j.lastConvTime = c.LastConvTime
+	}
+	return j, nil
+}
+
+// findCheckpoints returns the jobs which are not done, in the order they were queued
+func findCheckpoints() ([]checkpoint, error) {
+	var list []checkpoint
+
+	_, err := MysqlORM.QueryTable(new(checkpoint)).Filter("done", 0).OrderBy("id").All(&list)
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// saveCheckpoints inserts a checkpoint for each job which has none yet. A job
+// which can not be saved is still fetched, it just can not be resumed
+func (sch *scheduler) saveCheckpoints(jobs []job) {
+	if !sch.checkpoints {
+		return
+	}
+
+	for i := range jobs {
+		if jobs[i].checkpoint != 0 {
+			continue
+		}
+		c := newCheckpoint(jobs[i])
+		err := c.insert(sch.ctx)
+		if err != nil {
+			logErrorf("checkpoint %s %v", jobs[i].String(), err)
+			continue
+		}
+		jobs[i].checkpoint = c.ID
+	}
+}
+
+// pageSaved records that the pages of j before its offset are persisted
+func (sch *scheduler) pageSaved(ctx context.Context, j job, lastConvTime time.Time) {
+	if !sch.checkpoints || j.checkpoint == 0 {
+		return
+	}
+
+	err := advanceCheckpoint(ctx, j, lastConvTime)
+	if err != nil {
+		logErrorf("checkpoint %s %v", j.String(), err)
+	}
+}
+
+// jobDone records that all the pages of j are persisted, or queued again as
+// smaller jobs
+func (sch *scheduler) jobDone(ctx context.Context, j job) {
+	if !sch.checkpoints || j.checkpoint == 0 {
+		return
+	}
+
+	err := finishCheckpoint(ctx, j)
+	if err != nil {
+		logErrorf("checkpoint %s %v", j.String(), err)
+	}
+}
+
+// resumeJobs queues the jobs which are not done, from their last checkpoint.
+// It returns the number of resumed jobs
+func (sch *scheduler) resumeJobs() (int, error) {
+	var jobs []job
+
+	list, err := findCheckpoints()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range list {
+		j, err := list[i].job()
+		if err != nil {
+			logErrorf("resume checkpoint id=%d %v", list[i].ID, err)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+
+	sch.queueJobs(jobs)
+	return len(jobs), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpointJob(t *testing.T) {
+	fromTime, _ := strToTimeNoT("2017-02-13 00:00:00")
+	toTime, _ := strToTimeNoT("2017-02-13 01:00:00")
+	j := job{from: fromTime, to: toTime, offset: 300, limit: 50, run: "fetch-20170213000000",
+		nextPage: "/conversion.json?offset=300&limit=50", account: flagAccount()}
+
+	c := newCheckpoint(j)
+	assert.Equal(t, 0, c.Done)
+	assert.Equal(t, fromTime, c.LastConvTime)
+
+	c.ID = 7
+	cj, err := c.job()
+	assert.NoError(t, err)
+	assert.Equal(t, 7, cj.checkpoint)
+	assert.Equal(t, j.run, cj.run)
+	assert.Equal(t, j.offset, cj.offset)
+	assert.Equal(t, j.limit, cj.limit)
+	assert.Equal(t, j.nextPage, cj.nextPage)
+	assert.Equal(t, j.from, cj.from)
+	assert.Equal(t, j.to, cj.to)
+	assert.Equal(t, fromTime, cj.savedUntil())
+
+	// the conversion time of the last saved item is restored
+	c.LastConvTime = fromTime.Add(20 * time.Minute)
+	cj, _ = c.job()
+	assert.Equal(t, c.LastConvTime, cj.savedUntil())
+}
+
+func TestCheckpointFailure(t *testing.T) {
+	from := time.Date(2017, 2, 13, 0, 0, 0, 0, time.UTC)
+	a := &account{ID: 3, Name: "cn"}
+
+	// no checkpoint can be saved, the jobs are fetched anyway
+	useFakeDB(t, "faileddb")
+	source := &sliceSource{busySlice: 24 * time.Hour}
+	sch := newScheduler(2, source, nil)
+	sch.checkpoints = true
+	sch.createWorker(2)
+	jobs, err := sliceAccountJobs([]*account{a}, from, from.Add(3*time.Hour), time.Hour)
+	assert.NoError(t, err)
+
+	sch.saveCheckpoints(jobs)
+	for _, j := range jobs {
+		assert.Equal(t, 0, j.checkpoint)
+	}
+
+	sch.receiveJobs(jobs)
+	sch.wait()
+	assert.Len(t, source.done, 3)
+}
+
+func TestSaveCheckpoints(t *testing.T) {
+	from := time.Date(2017, 2, 13, 0, 0, 0, 0, time.UTC)
+	a := &account{ID: 3, Name: "cn"}
+
+	useFakeDB(t, "fakedb")
+	sch := newScheduler(1, nil, nil)
+	sch.checkpoints = true
+	jobs, err := sliceAccountJobs([]*account{a}, from, from.Add(2*time.Hour), time.Hour)
+	assert.NoError(t, err)
+
+	sch.saveCheckpoints(jobs)
+	for _, j := range jobs {
+		assert.NotEqual(t, 0, j.checkpoint)
+	}
+}
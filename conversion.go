@@ -1,21 +1,26 @@
 package main
 
+import "context"
 import "time"
 import "fmt"
+import "strings"
 import "github.com/astaxie/beego/orm"
-import _ "github.com/go-sql-driver/mysql"
-import "github.com/golang/glog"
+import "github.com/go-sql-driver/mysql"
 
 var (
 	MysqlORM orm.Ormer
 )
 
 type conversionRaw struct {
-	ID           int       `orm:"column(id);pk"`
-	RawData      string    `orm:"column(raw_data)"`
-	ConversionID string    `orm:"column(conversion_id)"`
-	CreatedAt    time.Time `orm:"column(created_at);type(timestamp)"`
-	UpdatedAt    time.Time `orm:"column(updated_at);type(timestamp)"`
+	ID             int       `orm:"column(id);pk"`
+	RawData        string    `orm:"column(raw_data)"`
+	ConversionID   string    `orm:"column(conversion_id)"`
+	ConversionTime time.Time `orm:"column(conversion_time);type(timestamp)"`
+	Atoken         string    `orm:"column(at)"`
+	CurrencyMode   string    `orm:"column(currency_mode)"` // see restoreCurrency
+	Origin         string    `orm:"column(origin)"`
+	CreatedAt      time.Time `orm:"column(created_at);type(timestamp)"`
+	UpdatedAt      time.Time `orm:"column(updated_at);type(timestamp)"`
 }
 
 func (c *conversionRaw) TableName() string {
@@ -27,79 +32,309 @@ func (c *conversionRaw) insert() error {
 	return err
 }
 
+// upsert keeps the latest payload of a conversion, for example when its status changes
+func (c *conversionRaw) upsert(ctx context.Context) error {
+	sql := `INSERT INTO %s (conversion_id, conversion_time, at, raw_data, currency_mode, origin, created_at, updated_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    ON DUPLICATE KEY UPDATE raw_data=VALUES(raw_data), currency_mode=VALUES(currency_mode),
+    origin=VALUES(origin), updated_at=VALUES(updated_at)`
+	sql = fmt.Sprintf(sql, c.TableName())
+
+	_, err := dbExec(ctx, sql, c.ConversionID, reportTimeStr(c.ConversionTime), c.Atoken, c.RawData,
+		c.CurrencyMode, c.Origin, reportTimeStr(c.CreatedAt), reportTimeStr(c.UpdatedAt))
+	return err
+}
+
+// findRawByTime returns at most num raw conversions in [from, to) with id larger than lastID
+func findRawByTime(ctx context.Context, from, to time.Time, lastID, num int) ([]conversionRaw, error) {
+	var list []conversionRaw
+
+	sql := `select id, conversion_id, conversion_time, at, raw_data, currency_mode, origin from affi_conversion_raw
+    where conversion_time >= ? and conversion_time < ? and id > ? order by id limit ?`
+	rows, err := dbQuery(ctx, sql, reportTimeStr(from), reportTimeStr(to), lastID, num)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var raw conversionRaw
+		var convTime string
+
+		err = rows.Scan(&raw.ID, &raw.ConversionID, &convTime, &raw.Atoken, &raw.RawData,
+			&raw.CurrencyMode, &raw.Origin)
+		if err != nil {
+			return nil, err
+		}
+		raw.ConversionTime, err = strToTimeNoT(convTime)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, raw)
+	}
+
+	return list, rows.Err()
+}
+
 type conversion struct {
-	ID                  int       `orm:"column(id);pk;auto"`
-	PayTime             int       `orm:"column(pay_time)"`
-	PayTimeDay          int       `orm:"column(pay_time_day)"`
-	ConversionID        string    `orm:"column(conversion_id)"`
-	UID                 int       `orm:"column(uid)"`
-	AppID               string    `orm:"column(app_id)"`
-	CustomerRef         string    `orm:"column(customer_reference)"`
-	ConversionStatus    string    `orm:"column(conversion_status)"`
-	Atoken              string    `orm:"column(at)"`
-	ConversionValue     float32   `orm:"column(conversion_value)"`
-	PublisherCommission float32   `orm:"column(publisher_commission)"`
-	PayUserAmount       float32   `orm:"column(pay_user_amount)"`
-	ConversionTime      time.Time `orm:"column(conversion_time);type(timestamp)"`
-	CreatedAt           time.Time `orm:"column(created_at);type(timestamp)"`
-	UpdatedAt           time.Time `orm:"column(updated_at);type(timestamp)"`
-	PayedUser           byte      `orm:"column(payed_user)"`
-	Type                byte      `orm:"column(type)"`
-	InApp               byte      `orm:"column(in_app)"`
+	ID               int     `orm:"column(id);pk;auto"`
+	PayTime          int     `orm:"column(pay_time)"`
+	PayTimeDay       int     `orm:"column(pay_time_day)"`
+	ConversionID     string  `orm:"column(conversion_id)"`
+	UID              int     `orm:"column(uid)"`
+	AppID            string  `orm:"column(app_id)"`
+	CustomerRef      string  `orm:"column(customer_reference)"`
+	ConversionStatus string  `orm:"column(conversion_status)"`
+	Atoken           string  `orm:"column(at)"`
+	ConversionValue  float32 `orm:"column(conversion_value)"`
+	// value and currency code in local currency, empty currency if unknown
+	ConversionValueOrigin float32   `orm:"column(conversion_value_origin)"`
+	ConversionCurrency    string    `orm:"column(conversion_currency)"`
+	PublisherCommission   float32   `orm:"column(publisher_commission)"`
+	PayUserAmount         float32   `orm:"column(pay_user_amount)"`
+	ConversionTime        time.Time `orm:"column(conversion_time);type(timestamp)"`
+	CreatedAt             time.Time `orm:"column(created_at);type(timestamp)"`
+	UpdatedAt             time.Time `orm:"column(updated_at);type(timestamp)"`
+	PayedUser             byte      `orm:"column(payed_user)"`
+	Type                  byte      `orm:"column(type)"`
+	InApp                 byte      `orm:"column(in_app)"`
+	// json of the extra groups matched in publisher_reference
+	Tags string `orm:"column(tags)"`
 }
 
 func (c *conversion) TableName() string {
-	return fmt.Sprintf("affi_conversion_%s", c.ConversionTime.Format("200601"))
+	return getConvTableNameByTime(c.ConversionTime)
 }
 
+const (
+	// the most two timezones differ, UTC-12 to UTC+14
+	maxTZSpread = 26 * time.Hour
+	// mysql error of a table which does not exist
+	errNoSuchTable = 1146
+)
+
+// conversionColumns are all the columns of a monthly table but id
+const conversionColumns = `conversion_id, conversion_time, uid, app_id, customer_reference,
+    conversion_status, conversion_value, conversion_value_origin, conversion_currency,
+    publisher_commission, apple_payed_us, apple_amount, apple_amount_usd, apple_currency,
+    pay_user_amount, payed_user, app_payment_id, pay_time, pay_time_day, type, at, in_app, tags,
+    created_at, updated_at`
+
+// getConvTableNameByTime is the monthly table of date in the report timezone
 func getConvTableNameByTime(date time.Time) string {
-	return fmt.Sprintf("affi_conversion_%s", date.Format("200601"))
+	return fmt.Sprintf("affi_conversion_%s", reportMonth(date))
 }
 
-func (c *conversion) insert() error {
+func (c *conversion) insert(ctx context.Context) error {
 	sql := `INSERT INTO %s 
     (conversion_id, conversion_time, uid, app_id, customer_reference,
-    conversion_status, conversion_value, publisher_commission, 
-    payed_user, pay_user_amount, pay_time, pay_time_day, type, at, in_app, 
+    conversion_status, conversion_value, conversion_value_origin, conversion_currency, publisher_commission, 
+    payed_user, pay_user_amount, pay_time, pay_time_day, type, at, in_app, tags, 
     created_at, updated_at) 
-    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)    
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)    
     `
 	sql = fmt.Sprintf(sql, c.TableName())
 
-	_, err := MysqlORM.Raw(sql, c.ConversionID, c.ConversionTime.Format("2006-01-02T15:04:05"),
+	_, err := dbExec(ctx, sql, c.ConversionID, reportTimeStr(c.ConversionTime),
 		c.UID, c.AppID, c.CustomerRef, c.ConversionStatus, c.ConversionValue,
-		c.PublisherCommission, c.PayedUser, c.PayUserAmount, c.PayTime,
-		c.PayTimeDay, c.Type, c.Atoken, c.InApp, c.CreatedAt.Format("2006-01-02T15:04:05"),
-		c.UpdatedAt.Format("2006-01-02T15:04:05")).Exec()
+		c.ConversionValueOrigin, c.ConversionCurrency, c.PublisherCommission, c.PayedUser, c.PayUserAmount, c.PayTime,
+		c.PayTimeDay, c.Type, c.Atoken, c.InApp, c.Tags, reportTimeStr(c.CreatedAt),
+		reportTimeStr(c.UpdatedAt))
 	return err
 }
 
-func (c *conversion) update(status string, conversionVal float32) error {
+// save inserts the conversion, or updates status and value of an existing one
+// and records the change observed by run. A conversion without value is not
+// inserted, but the change of an existing one to no value is saved, for
+// example when it is rejected
+func (c *conversion) save(ctx context.Context, run string) error {
+	conv, err := findByConversionID(ctx, c.ConversionTime, c.ConversionID)
+	if err == orm.ErrNoRows {
+		if c.ConversionValue <= 0 {
+			return nil
+		}
+		return c.insert(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	if conv.ConversionStatus == c.ConversionStatus && conv.ConversionValue == c.ConversionValue {
+		return nil
+	}
+	// the change is saved with its history or not at all
+	return dbTx(ctx, func(tx execer) error {
+		err := conv.update(ctx, tx, c.ConversionStatus, c.ConversionValue)
+		if err != nil {
+			return err
+		}
+		return newStatusHistory(conv, c, run).insert(ctx, tx)
+	})
+}
+
+// rebuild inserts the conversion, or overwrites all the fields parsed from
+// the API of an existing one, and those derived from them, see rebuildColumns.
+// A row saved to the table of another month, before -reportTZ was changed, is
+// moved to the table of its month first. Like save, a conversion without value
+// is only saved over an existing one. It returns false if nothing was saved
+func (c *conversion) rebuild(ctx context.Context, run string) (bool, error) {
+	table := c.TableName()
+	conv, err := findByConversionID(ctx, c.ConversionTime, c.ConversionID)
+	if err == orm.ErrNoRows {
+		conv, table, err = findInOtherMonth(ctx, c.ConversionTime, c.ConversionID)
+	}
+	if err == orm.ErrNoRows {
+		if c.ConversionValue <= 0 {
+			return false, nil
+		}
+		return true, c.insert(ctx)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	columns, args := c.rebuildColumns(conv)
+	sql := fmt.Sprintf(`update %s set %s where id = ?`, c.TableName(), strings.Join(columns, ", "))
+
+	err = dbTx(ctx, func(tx execer) error {
+		id := conv.ID
+		if table != c.TableName() {
+			var err error
+			id, err = moveConversion(ctx, tx, table, c.TableName(), conv.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.ExecContext(ctx, sql, append(args, id)...)
+		if err != nil {
+			return err
+		}
+
+		if conv.ConversionStatus != c.ConversionStatus || conv.ConversionValue != c.ConversionValue {
+			return newStatusHistory(conv, c, run).insert(ctx, tx)
+		}
+		return nil
+	})
+	return err == nil, err
+}
+
+// findInOtherMonth looks for the conversion in the tables of the months next
+// to its own, where another report timezone could have saved it. It returns
+// the row and its table
+func findInOtherMonth(ctx context.Context, date time.Time, conversionID string) (*conversion, string, error) {
+	for _, table := range neighborTables(date) {
+		c, err := findConversionIn(ctx, table, conversionID)
+		if err == orm.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return c, table, nil
+	}
+
+	return nil, "", orm.ErrNoRows
+}
+
+// neighborTables are the monthly tables other than its own which a conversion
+// at date could be saved to in another report timezone
+func neighborTables(date time.Time) []string {
+	var tables []string
+
+	own := getConvTableNameByTime(date)
+	for _, t := range []time.Time{date.Add(-maxTZSpread), date.Add(maxTZSpread)} {
+		table := getConvTableNameByTime(t)
+		if table != own {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// moveConversion copies the row id of table from to table to and deletes it
+// from from. It returns the id of the row in to
+func moveConversion(ctx context.Context, tx execer, from, to string, id int) (int, error) {
+	sql := fmt.Sprintf(`insert into %s (%s) select %s from %s where id = ?`, to, conversionColumns,
+		conversionColumns, from)
+	res, err := tx.ExecContext(ctx, sql, id)
+	if err != nil {
+		return 0, err
+	}
+	newID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`delete from %s where id = ?`, from), id)
+	if err != nil {
+		return 0, err
+	}
+	return int(newID), nil
+}
+
+// rebuildColumns is the assignments and values rebuild writes over the row
+// old. The local values are only written if the payload has them, else they
+// are those of the self-bill importer, and a paid out pay_user_amount is kept
+func (c *conversion) rebuildColumns(old *conversion) ([]string, []interface{}) {
+	columns := []string{"conversion_time=?", "uid=?", "app_id=?", "customer_reference=?",
+		"conversion_status=?", "conversion_value=?", "publisher_commission=?", "pay_time=?",
+		"pay_time_day=?", "type=?", "at=?", "in_app=?", "tags=?", "updated_at=?"}
+	args := []interface{}{reportTimeStr(c.ConversionTime), c.UID, c.AppID, c.CustomerRef,
+		c.ConversionStatus, c.ConversionValue, c.PublisherCommission, c.PayTime,
+		c.PayTimeDay, c.Type, c.Atoken, c.InApp, c.Tags, reportTimeStr(time.Now())}
+
+	if c.ConversionCurrency != "" {
+		columns = append(columns, "conversion_value_origin=?", "conversion_currency=?")
+		args = append(args, c.ConversionValueOrigin, c.ConversionCurrency)
+	}
+	if old.PayedUser != 1 {
+		columns = append(columns, "pay_user_amount=?")
+		args = append(args, c.PayUserAmount)
+	}
+
+	return columns, args
+}
+
+func (c *conversion) update(ctx context.Context, tx execer, status string, conversionVal float32) error {
 	tableName := c.TableName()
 	sql := fmt.Sprintf(`update %s set conversion_status=?, conversion_value=? where id = ? `, tableName)
-	_, err := MysqlORM.Raw(sql, status, conversionVal, c.ID).Exec()
+	_, err := tx.ExecContext(ctx, sql, status, conversionVal, c.ID)
 	if err != nil {
-		glog.Error(err)
+		logError(err)
 		return err
 	}
 
 	return nil
 }
 
-func findByConversionID(date time.Time, conversionID string) (*conversion, error) {
-	c := conversion{}
-	c.ConversionTime = date
-	tableName := c.TableName()
-
-	sql := fmt.Sprintf(`select id, conversion_time from %s where conversion_id = ?`, tableName)
-	err := MysqlORM.Raw(sql, conversionID).QueryRow(&c)
+func findByConversionID(ctx context.Context, date time.Time, conversionID string) (*conversion, error) {
+	c, err := findConversionIn(ctx, getConvTableNameByTime(date), conversionID)
 	if err != nil {
 		if err != orm.ErrNoRows {
-			glog.Error(err)
+			logError(err)
 		}
 		return nil, err
 	}
 
+	c.ConversionTime = date
+	return c, nil
+}
+
+// findConversionIn reads the conversion from table. A table which does not
+// exist has no rows
+func findConversionIn(ctx context.Context, table, conversionID string) (*conversion, error) {
+	c := conversion{}
+	sql := fmt.Sprintf(`select id, conversion_status, conversion_value, payed_user from %s where conversion_id = ?`, table)
+	err := dbQueryRow(ctx, sql, []interface{}{conversionID}, &c.ID, &c.ConversionStatus, &c.ConversionValue,
+		&c.PayedUser)
+	if myErr, ok := err.(*mysql.MySQLError); ok && myErr.Number == errNoSuchTable {
+		return nil, orm.ErrNoRows
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	return &c, nil
 }
 
@@ -112,6 +347,14 @@ func InitDB(host, user, pwd, db string) orm.Ormer {
 		orm.RegisterModel(new(conversion))
 		orm.RegisterModel(new(conversionRaw))
 		orm.RegisterModel(new(applePayment))
+		orm.RegisterModel(new(deadLetter))
+		orm.RegisterModel(new(account))
+		orm.RegisterModel(new(watermark))
+		orm.RegisterModel(new(statusHistory))
+		orm.RegisterModel(new(conversionDetail))
+		orm.RegisterModel(new(exchangeRate))
+		orm.RegisterModel(new(quarantine))
+		orm.RegisterModel(new(checkpoint))
 
 		MysqlORM = orm.NewOrm()
 	}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
@@ -26,10 +28,10 @@ func TestInsertConversion(t *testing.T) {
 	// c.CreatedAt = time.Now()
 	// c.UpdatedAt = time.Now()
 
-	// err := c.insert()
+	// err := c.insert(context.Background())
 	// assert.NoError(t, err)
 
-	// c, err := findByConversionID(time.Now(), "no exists")
+	// c, err := findByConversionID(context.Background(), time.Now(), "no exists")
 	// assert.Equal(t, orm.ErrNoRows, err)
 	// assert.Nil(t, c)
 
@@ -37,7 +39,106 @@ func TestInsertConversion(t *testing.T) {
 	c.ID = 43430
 	c.ConversionTime = time.Now()
 
-	err := c.update("approved", 19.99)
+	err := dbTx(context.Background(), func(tx execer) error {
+		return c.update(context.Background(), tx, "approved", 19.99)
+	})
 	assert.NoError(t, err)
 
 }
+
+func TestStatusHistory(t *testing.T) {
+	old := &conversion{ID: 1, ConversionStatus: "pending", ConversionValue: 4.99}
+	fetched := &conversion{ConversionID: "1000l893029726001", ConversionTime: time.Now(), ConversionStatus: "rejected", ConversionValue: 0.99}
+
+	h := newStatusHistory(old, fetched, "fetch-20170213101500")
+	assert.Equal(t, "1000l893029726001", h.ConversionID)
+	assert.Equal(t, "pending", h.OldStatus)
+	assert.Equal(t, "rejected", h.NewStatus)
+	assert.Equal(t, float32(4.99), h.OldValue)
+	assert.Equal(t, float32(0.99), h.NewValue)
+	assert.Equal(t, "fetch-20170213101500", h.Run)
+}
+
+func TestConversionDetail(t *testing.T) {
+	source, err := newFileSource("testdata/conversions.json")
+	assert.NoError(t, err)
+
+	data := source.conversions[0].ConvData
+	d := data.toDetail(time.Now())
+	assert.Equal(t, "CN", d.Country)
+	assert.Equal(t, "iPhone", d.Device)
+	assert.Equal(t, "CNY", d.Currency)
+	assert.Equal(t, "10.0.0.1", d.ClickIP)
+	assert.Contains(t, d.MetaData, "sdk_version")
+
+	fromTime, _ := strToTimeNoT("2017-01-15 00:00:00")
+	toTime, _ := strToTimeNoT("2017-03-01 00:00:00")
+	assert.Equal(t, []string{"affi_conversion_201701", "affi_conversion_201702"}, convTableNames(fromTime, toTime))
+}
+
+func TestRebuildColumns(t *testing.T) {
+	raw := []byte(`{"conversion_data": {"conversion_id": "1", "conversion_time": "2017-02-13 00:12:05",
+		"publisher_reference": "u1024:com.example.game", "currency": "CNY",
+		"conversion_value": {"conversion_status": "approved", "value": 10, "publisher_commission": 0.7}}}`)
+
+	// the row has the local values of the self-bill importer and is paid out
+	old := &conversion{ID: 7, ConversionValueOrigin: 68, ConversionCurrency: "CNY", PayedUser: 1}
+
+	var item conversionItem
+	assert.NoError(t, json.Unmarshal(raw, &item))
+	c, err := item.restore("", nil, "at")
+	assert.NoError(t, err)
+
+	columns, args := c.rebuildColumns(old)
+	assert.Len(t, args, len(columns))
+	assert.Contains(t, columns, "conversion_value=?")
+	assert.NotContains(t, columns, "conversion_value_origin=?")
+	assert.NotContains(t, columns, "conversion_currency=?")
+	assert.NotContains(t, columns, "pay_user_amount=?")
+
+	// a payload fetched with local values writes them, an unpaid row its amount
+	c.ConversionValueOrigin, c.ConversionCurrency = 68, "CNY"
+	columns, args = c.rebuildColumns(&conversion{ID: 7})
+	assert.Len(t, args, len(columns))
+	assert.Contains(t, columns, "conversion_value_origin=?")
+	assert.Contains(t, columns, "pay_user_amount=?")
+}
+
+func TestNeighborTables(t *testing.T) {
+	mid, _ := strToTime("2017-02-13T10:00:00")
+	assert.Empty(t, neighborTables(mid))
+
+	first, _ := strToTime("2017-03-01T02:00:00")
+	assert.Equal(t, []string{"affi_conversion_201702"}, neighborTables(first))
+
+	last, _ := strToTime("2017-02-28T23:00:00")
+	assert.Equal(t, []string{"affi_conversion_201703"}, neighborTables(last))
+
+	useFakeDB(t, "fakedb")
+	err := dbTx(context.Background(), func(tx execer) error {
+		id, err := moveConversion(context.Background(), tx, "affi_conversion_201702", "affi_conversion_201703", 7)
+		assert.Equal(t, 1, id)
+		return err
+	})
+	assert.NoError(t, err)
+}
+
+func TestRebuildSaved(t *testing.T) {
+	useFakeDB(t, "fakedb")
+
+	// not in any table, only a conversion with value is inserted
+	c := &conversion{ConversionID: "1", ConversionStatus: "approved", ConversionTime: time.Now()}
+	saved, err := c.rebuild(context.Background(), "run")
+	assert.NoError(t, err)
+	assert.False(t, saved)
+
+	c.ConversionValue = 9.99
+	saved, err = c.rebuild(context.Background(), "run")
+	assert.NoError(t, err)
+	assert.True(t, saved)
+
+	useFakeDB(t, "faileddb")
+	saved, err = c.rebuild(context.Background(), "run")
+	assert.Error(t, err)
+	assert.False(t, saved)
+}
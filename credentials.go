@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// credentials of the default account, instead of -appKey and -apiKey
+	envAppKey = "AFFI_APP_KEY"
+	envAPIKey = "AFFI_API_KEY"
+
+	// shorter values are not redacted, they would mangle every line
+	minSecretLen = 4
+)
+
+var (
+	// credentials by account name, read from -secrets
+	accountSecrets map[string]accountSecret
+
+	secrets     []string
+	secretMutex sync.RWMutex
+
+	// password in the userinfo of a url
+	userinfoRe = regexp.MustCompile(`(://[^:@/\s]*):[^@/\s]*@`)
+)
+
+// accountSecret is the credentials of an account in the secrets file
+type accountSecret struct {
+	AppKey string `json:"app_key"`
+	APIKey string `json:"api_key"`
+}
+
+// loadSecrets reads a json file like {"default": {"app_key": "...", "api_key": "..."}}.
+// The file must not be readable by group or others
+func loadSecrets(path string) (map[string]accountSecret, error) {
+	var list map[string]accountSecret
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("secrets file %s is %s, chmod 600 it", path, fi.Mode().Perm())
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return nil, fmt.Errorf("secrets file %s: %v", path, err)
+	}
+
+	return list, nil
+}
+
+// setCredentials takes the credentials of a from the secrets file if it is
+// there, and registers them for redaction
+func setCredentials(a *account) {
+	if s, ok := accountSecrets[a.Name]; ok {
+		a.AppKey = s.AppKey
+		a.APIKey = s.APIKey
+	}
+
+	registerSecret(a.AppKey)
+	registerSecret(a.APIKey)
+}
+
+// envOr returns the environment variable key if it is set, otherwise val
+func envOr(key, val string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return val
+}
+
+// authHeader is the basic auth header of the API, so credentials never go
+// into urls
+func (a *account) authHeader() map[string]string {
+	auth := base64.StdEncoding.EncodeToString([]byte(a.AppKey + ":" + a.APIKey))
+	return map[string]string{"Authorization": "Basic " + auth}
+}
+
+// GoString keeps credentials out of %#v
+func (a *account) GoString() string {
+	return fmt.Sprintf("&account{ID:%d, Name:%q, PublisherID:%q, Atoken:%q, Enabled:%d}",
+		a.ID, a.Name, a.PublisherID, a.Atoken, a.Enabled)
+}
+
+func registerSecret(s string) {
+	if len(s) < minSecretLen {
+		return
+	}
+
+	secretMutex.Lock()
+	defer secretMutex.Unlock()
+
+	for _, old := range secrets {
+		if old == s {
+			return
+		}
+	}
+	secrets = append(secrets, s)
+}
+
+// redact replaces the registered credentials and url passwords in s
+func redact(s string) string {
+	s = userinfoRe.ReplaceAllString(s, "$1:"+redacted+"@")
+
+	secretMutex.RLock()
+	defer secretMutex.RUnlock()
+
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	return s
+}
+
+// redactedError is an error whose message went through redact
+func redactedError(err error) string {
+	if err == nil {
+		return ""
+	}
+	return redact(err.Error())
+}
+
+// logError logs like glog.Error once redacted. Errors are always logged
+// through it or logErrorf, they may carry the DSN or a request URL
+func logError(args ...interface{}) {
+	glog.ErrorDepth(1, redact(fmt.Sprint(args...)))
+}
+
+// logErrorf logs like glog.Errorf once redacted
+func logErrorf(format string, args ...interface{}) {
+	glog.ErrorDepth(1, redact(fmt.Sprintf(format, args...)))
+}
+
+// redactWriter redacts the lines of the standard logger
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r redactWriter) Write(p []byte) (int, error) {
+	_, err := r.w.Write([]byte(redact(string(p))))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// values converted to USD by the API, as before
+	currencyUSD = "usd"
+	// values in local currency, converted to USD with affi_exchange_rate
+	currencyNative = "native"
+	// both, with one more request for each page
+	currencyBoth = "both"
+)
+
+// convOrigin is the value of a conversion in local currency
+type convOrigin struct {
+	Currency            string  `json:"currency"`
+	Value               float32 `json:"value"`
+	PublisherCommission float32 `json:"publisher_commission"`
+}
+
+// exchangeRate is how much of a currency one USD buys on a day
+type exchangeRate struct {
+	ID       int       `orm:"column(id);pk;auto"`
+	Currency string    `orm:"column(currency)"`
+	Day      time.Time `orm:"column(day);type(date)"`
+	Rate     float64   `orm:"column(rate)"`
+}
+
+func (e *exchangeRate) TableName() string {
+	return "affi_exchange_rate"
+}
+
+// exchangeRates converts local currency to USD
+type exchangeRates interface {
+	toUSD(currency string, value float32, day time.Time) (float32, error)
+}
+
+// dbRates reads affi_exchange_rate, taking the latest rate not after the day.
+// Only the rates of the day itself are cached, an earlier one is looked up
+// again in case the rate of the day is added later
+type dbRates struct {
+	cache map[string]float64
+	mutex sync.Mutex
+	find  func(currency string, day time.Time) (exchangeRate, error)
+}
+
+func newDBRates() *dbRates {
+	return &dbRates{
+		cache: make(map[string]float64),
+		mutex: sync.Mutex{},
+		find:  findExchangeRate,
+	}
+}
+
+// findExchangeRate returns the latest rate of currency not after day
+func findExchangeRate(currency string, day time.Time) (exchangeRate, error) {
+	var e exchangeRate
+	err := MysqlORM.QueryTable(new(exchangeRate)).Filter("currency", currency).
+		Filter("day__lte", day.Format("2006-01-02")).OrderBy("-day").One(&e)
+	return e, err
+}
+
+func (r *dbRates) toUSD(currency string, value float32, day time.Time) (float32, error) {
+	if currency == "USD" {
+		return value, nil
+	}
+
+	rate, err := r.rate(currency, day)
+	if err != nil {
+		return 0, err
+	}
+
+	return float32(float64(value) / rate), nil
+}
+
+func (r *dbRates) rate(currency string, day time.Time) (float64, error) {
+	// rates are daily in the report timezone
+	day = day.In(reportLoc)
+	key := currency + day.Format("20060102")
+
+	r.mutex.Lock()
+	rate, ok := r.cache[key]
+	r.mutex.Unlock()
+	if ok {
+		return rate, nil
+	}
+
+	e, err := r.find(currency, day)
+	if err != nil {
+		return 0, fmt.Errorf("no exchange rate of %s on %s: %v", currency, day.Format("2006-01-02"), err)
+	}
+	if e.Rate <= 0 {
+		return 0, fmt.Errorf("exchange rate of %s on %s is %f", currency, day.Format("2006-01-02"), e.Rate)
+	}
+
+	if e.Day.In(reportLoc).Format("20060102") == day.Format("20060102") {
+		r.mutex.Lock()
+		r.cache[key] = e.Rate
+		r.mutex.Unlock()
+	}
+
+	return e.Rate, nil
+}
+
+// convertToUSD keeps the local values of a conversion fetched in native
+// currency as origin, and converts the values to USD. data is not changed if
+// a rate is missing
+func convertToUSD(data *conversionData, rates exchangeRates) error {
+	t, err := strToTimeForConv(data.ConversionTime)
+	if err != nil {
+		return err
+	}
+
+	value, err := rates.toUSD(data.Currency, data.Value.Value, t)
+	if err != nil {
+		return err
+	}
+	commission, err := rates.toUSD(data.Currency, data.Value.PublisherCommission, t)
+	if err != nil {
+		return err
+	}
+
+	data.Origin = originOf(data)
+	data.Value.Value = value
+	data.Value.PublisherCommission = commission
+	return nil
+}
+
+// originOf is the local values of a conversion fetched in native currency
+func originOf(data *conversionData) *convOrigin {
+	return &convOrigin{
+		Currency:            data.Currency,
+		Value:               data.Value.Value,
+		PublisherCommission: data.Value.PublisherCommission,
+	}
+}
+
+// originJSON is the local values of the item, stored with its payload. Empty
+// if they are unknown
+func (c *conversionItem) originJSON() string {
+	if c.ConvData.Origin == nil {
+		return ""
+	}
+	b, err := json.Marshal(c.ConvData.Origin)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// restoreCurrency makes the data of a stored payload as it was when saved. A
+// payload fetched in native currency has local values, they are converted to
+// USD again. The local values of a payload fetched in both are set from origin
+func restoreCurrency(data *conversionData, mode, origin string, rates exchangeRates) error {
+	switch mode {
+	case currencyNative:
+		return convertToUSD(data, rates)
+	case currencyBoth:
+		if origin == "" {
+			return nil
+		}
+		var o convOrigin
+		err := json.Unmarshal([]byte(origin), &o)
+		if err != nil {
+			return err
+		}
+		data.Origin = &o
+	}
+	return nil
+}
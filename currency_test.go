@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fixedRates map[string]float64
+
+func (r fixedRates) toUSD(currency string, value float32, day time.Time) (float32, error) {
+	rate, ok := r[currency]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate of %s", currency)
+	}
+	return float32(float64(value) / rate), nil
+}
+
+func TestConvertToUSD(t *testing.T) {
+	data := conversionData{ID: "1", ConversionTime: "2017-02-13 00:12:05", PublisherRef: "u1024:com.example.game", Currency: "CNY", Value: convValue{Value: 68, PublisherCommission: 4.76}}
+
+	err := convertToUSD(&data, fixedRates{"CNY": 6.8, "USD": 1})
+	assert.NoError(t, err)
+	assert.InDelta(t, 10, data.Value.Value, 0.001)
+	assert.Equal(t, float32(68), data.Origin.Value)
+	assert.Equal(t, "CNY", data.Origin.Currency)
+
+	c, err := data.toConversion("at")
+	assert.NoError(t, err)
+	assert.Equal(t, float32(68), c.ConversionValueOrigin)
+	assert.Equal(t, "CNY", c.ConversionCurrency)
+
+	usd := conversionData{ID: "2", ConversionTime: "2017-02-13 03:40:51", Currency: "USD", Value: convValue{Value: 0.99, PublisherCommission: 0.07}}
+	err = convertToUSD(&usd, fixedRates{"CNY": 6.8, "USD": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, float32(0.99), usd.Value.Value)
+
+	jpy := conversionData{ID: "3", ConversionTime: "2017-02-13 03:40:51", Currency: "JPY", Value: convValue{Value: 120}}
+	err = convertToUSD(&jpy, fixedRates{})
+	assert.Error(t, err)
+	assert.Equal(t, float32(120), jpy.Value.Value)
+	assert.Nil(t, jpy.Origin)
+
+	// the item is quarantined rather than saved with local values
+	item := conversionItem{ConvData: jpy, convErr: err}
+	_, err = item.toConversion("at")
+	assert.Equal(t, item.convErr, err)
+}
+
+func TestOriginOf(t *testing.T) {
+	native := conversionData{ID: "1", Currency: "CNY", Value: convValue{Value: 68, PublisherCommission: 4.76}}
+
+	origin := originOf(&native)
+	assert.Equal(t, float32(68), origin.Value)
+	assert.Equal(t, float32(4.76), origin.PublisherCommission)
+	assert.Equal(t, "CNY", origin.Currency)
+}
+
+func TestRestoreCurrency(t *testing.T) {
+	raw := []byte(`{"conversion_data": {"conversion_id": "1", "conversion_time": "2017-02-13 00:12:05",
+		"publisher_reference": "u1024:com.example.game", "currency": "CNY",
+		"conversion_value": {"conversion_status": "approved", "value": 68, "publisher_commission": 4.76}}}`)
+	rates := fixedRates{"CNY": 6.8, "USD": 1}
+
+	// a payload fetched in native currency is converted again
+	var item conversionItem
+	assert.NoError(t, json.Unmarshal(raw, &item))
+	item.currency = currencyNative
+	c, err := item.restore("", rates, "at")
+	assert.NoError(t, err)
+	assert.InDelta(t, 10, c.ConversionValue, 0.001)
+	assert.Equal(t, float32(68), c.ConversionValueOrigin)
+
+	// a usd payload keeps its values, with the local ones of the raw row
+	item = conversionItem{}
+	assert.NoError(t, json.Unmarshal(raw, &item))
+	item.currency = currencyBoth
+	c, err = item.restore(`{"currency":"CNY","value":462.4,"publisher_commission":32.37}`, rates, "at")
+	assert.NoError(t, err)
+	assert.Equal(t, float32(68), c.ConversionValue)
+	assert.Equal(t, float32(462.4), c.ConversionValueOrigin)
+	assert.Equal(t, "CNY", c.ConversionCurrency)
+
+	item.currency = currencyNative
+	_, err = item.restore("", fixedRates{}, "at")
+	assert.Error(t, err)
+}
+
+func TestDBRatesCache(t *testing.T) {
+	var calls int
+	prev, _ := strToTime("2017-02-12T00:00:00")
+	r := newDBRates()
+	r.find = func(currency string, day time.Time) (exchangeRate, error) {
+		calls++
+		return exchangeRate{Currency: currency, Day: prev, Rate: 6.8}, nil
+	}
+
+	day, _ := strToTime("2017-02-13T10:00:00")
+	// the rate of the day before is not cached
+	for i := 0; i < 2; i++ {
+		rate, err := r.rate("CNY", day)
+		assert.NoError(t, err)
+		assert.Equal(t, 6.8, rate)
+	}
+	assert.Equal(t, 2, calls)
+
+	// the rate of the day is
+	for i := 0; i < 2; i++ {
+		_, err := r.rate("CNY", prev.Add(time.Hour))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 3, calls)
+}
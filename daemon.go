@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+	"github.com/golang/glog"
+)
+
+// watermark is the time before which all conversions of an account are fetched
+type watermark struct {
+	AccountID    int       `orm:"column(account_id);pk"`
+	FetchedUntil time.Time `orm:"column(fetched_until);type(datetime)"`
+	UpdatedAt    time.Time `orm:"column(updated_at);type(timestamp)"`
+}
+
+func (w *watermark) TableName() string {
+	return "affi_fetch_watermark"
+}
+
+func (w *watermark) save(ctx context.Context) error {
+	sql := `INSERT INTO %s (account_id, fetched_until, updated_at) VALUES (?, ?, ?)
+    ON DUPLICATE KEY UPDATE fetched_until=VALUES(fetched_until), updated_at=VALUES(updated_at)`
+	sql = fmt.Sprintf(sql, w.TableName())
+
+	_, err := dbExec(ctx, sql, w.AccountID, reportTimeStr(w.FetchedUntil), reportTimeStr(time.Now()))
+	return err
+}
+
+func findWatermark(ctx context.Context, accountID int) (*watermark, error) {
+	var fetchedUntil string
+
+	w := watermark{AccountID: accountID}
+	sql := fmt.Sprintf(`select fetched_until from %s where account_id = ?`, w.TableName())
+	err := dbQueryRow(ctx, sql, []interface{}{accountID}, &fetchedUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	w.FetchedUntil, err = strToTimeNoT(fetchedUntil)
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// syncer fetches from the watermark of each account to now on every interval
+type syncer struct {
+	sch      *scheduler
+	accounts []*account
+	interval time.Duration
+	overlap  time.Duration
+	// start time of accounts which have no watermark yet
+	initFrom time.Time
+}
+
+func (s *syncer) Start() {
+	for {
+		s.syncOnce()
+		time.Sleep(s.interval)
+	}
+}
+
+func (s *syncer) syncOnce() {
+	var jobs []job
+
+	now := time.Now().UTC()
+	from := make(map[int]time.Time)
+	for _, a := range s.accounts {
+		t, err := s.fromTime(a)
+		if err != nil {
+			logErrorf("account=%s %v", a.Name, err)
+			continue
+		}
+
+		accountJobs, err := sliceJobs(t, now, sliceSize)
+		if err != nil {
+			logErrorf("account=%s %v", a.Name, err)
+			continue
+		}
+		for i := range accountJobs {
+			accountJobs[i].account = a
+		}
+
+		from[a.ID] = t
+		jobs = append(jobs, accountJobs...)
+	}
+
+	if len(jobs) == 0 {
+		return
+	}
+
+	s.sch.resetFailures()
+	s.sch.receiveJobs(jobs)
+	s.sch.wait()
+
+	for _, a := range s.accounts {
+		if _, ok := from[a.ID]; !ok {
+			continue
+		}
+
+		if num := s.sch.failures(a.ID); num > 0 {
+			logErrorf("account=%s %d pages failed, watermark stays", a.Name, num)
+			continue
+		}
+
+		w := watermark{AccountID: a.ID, FetchedUntil: now}
+		err := w.save(s.sch.ctx)
+		if err != nil {
+			logErrorf("account=%s %v", a.Name, err)
+			continue
+		}
+		glog.Infof("account=%s synced from %s to %s", a.Name, from[a.ID].Format(time.RFC3339), now.Format(time.RFC3339))
+	}
+}
+
+// fromTime is the watermark minus overlap, so late conversions are not missed
+func (s *syncer) fromTime(a *account) (time.Time, error) {
+	w, err := findWatermark(s.sch.ctx, a.ID)
+	if err == orm.ErrNoRows {
+		return s.initFrom, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return w.FetchedUntil.Add(-s.overlap), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/astaxie/beego/orm"
+)
+
+// getDB returns the default database. Tests replace it with a fake one, so
+// that they never write to a real database
+var getDB = orm.GetDB
+
+// dbExec runs a write on the default database with ctx, so that canceling a
+// job aborts its queries. Raw of beego takes no context
+func dbExec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ExecContext(ctx, query, args...)
+}
+
+// dbQueryRow scans one row into dest with ctx. It returns orm.ErrNoRows like
+// Raw of beego if there is no row
+func dbQueryRow(ctx context.Context, query string, args []interface{}, dest ...interface{}) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+
+	err = db.QueryRowContext(ctx, query, args...).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return orm.ErrNoRows
+	}
+	return err
+}
+
+// dbQuery runs a query on the default database with ctx. The caller closes
+// the rows
+func dbQuery(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.QueryContext(ctx, query, args...)
+}
+
+// execer runs a write on the database or in a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// dbTx runs fn in a transaction with ctx. It is committed if fn returns nil,
+// rolled back otherwise
+func dbTx(ctx context.Context, fn func(tx execer) error) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDB accepts every write and finds no row, or fails every query with err
+type fakeDB struct {
+	err error
+}
+
+func init() {
+	sql.Register("fakedb", fakeDB{})
+	sql.Register("faileddb", fakeDB{err: errors.New("fake database is down")})
+}
+
+// useFakeDB makes the queries of the fetch path go to the fake database
+// driver until the test ends, whether a mysql is registered or not
+func useFakeDB(t *testing.T, driverName string) {
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := getDB
+	getDB = func(...string) (*sql.DB, error) { return db, nil }
+	t.Cleanup(func() {
+		getDB = saved
+		db.Close()
+	})
+}
+
+func (d fakeDB) Open(name string) (driver.Conn, error) {
+	return fakeConn(d), nil
+}
+
+type fakeConn fakeDB
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return fakeStmt{}, nil
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return fakeTx{}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct{}
+
+func (fakeStmt) Close() error  { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+
+func (fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return fakeResult{}, nil
+}
+
+func (fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return fakeRows{}, nil
+}
+
+type fakeResult struct{}
+
+func (fakeResult) LastInsertId() (int64, error) { return 1, nil }
+func (fakeResult) RowsAffected() (int64, error) { return 1, nil }
+
+type fakeRows struct{}
+
+func (fakeRows) Columns() []string              { return nil }
+func (fakeRows) Close() error                   { return nil }
+func (fakeRows) Next(dest []driver.Value) error { return io.EOF }
+
+func TestDBContext(t *testing.T) {
+	useFakeDB(t, "fakedb")
+
+	_, err := findWatermark(context.Background(), 1)
+	assert.Equal(t, orm.ErrNoRows, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = findWatermark(ctx, 1)
+	assert.Equal(t, context.Canceled, err)
+	_, err = findRawByTime(ctx, time.Now(), time.Now(), 0, 10)
+	assert.Equal(t, context.Canceled, err)
+	d := deadLetter{ID: 1}
+	assert.Equal(t, context.Canceled, d.update(ctx))
+}
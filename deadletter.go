@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// deadLetter is a page which failed after retries
+type deadLetter struct {
+	ID        int       `orm:"column(id);pk;auto" json:"id"`
+	AccountID int       `orm:"column(account_id)" json:"account_id"`
+	FromTime  time.Time `orm:"column(from_time);type(datetime)" json:"from_time"`
+	ToTime    time.Time `orm:"column(to_time);type(datetime)" json:"to_time"`
+	Offset    int       `orm:"column(offset)" json:"offset"`
+	Limit     int       `orm:"column(page_limit)" json:"limit"`
+	Error     string    `orm:"column(error)" json:"error"`
+	Attempts  int       `orm:"column(attempts)" json:"attempts"`
+	Replayed  int       `orm:"column(replayed)" json:"replayed"` // 0 pending, 1 replayed
+	CreatedAt time.Time `orm:"column(created_at);type(timestamp)" json:"created_at"`
+	UpdatedAt time.Time `orm:"column(updated_at);type(timestamp)" json:"updated_at"`
+}
+
+func (d *deadLetter) TableName() string {
+	return "affi_fetch_dead_letter"
+}
+
+func newDeadLetter(j job, err error) *deadLetter {
+	attempts := 1
+	if pageErr, ok := err.(*pageError); ok {
+		attempts = pageErr.attempts
+	}
+
+	d := &deadLetter{
+		AccountID: j.account.ID,
+		FromTime:  j.from,
+		ToTime:    j.to,
+		Offset:    j.offset,
+		Limit:     j.limit,
+		Error:     redactedError(err),
+		Attempts:  attempts,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	return d
+}
+
+func (d *deadLetter) insert(ctx context.Context) error {
+	sql := `INSERT INTO %s (account_id, from_time, to_time, offset, page_limit, error, attempts,
+    replayed, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?, ?)`
+	sql = fmt.Sprintf(sql, d.TableName())
+
+	res, err := dbExec(ctx, sql, d.AccountID, reportTimeStr(d.FromTime), reportTimeStr(d.ToTime),
+		d.Offset, d.Limit, d.Error, d.Attempts, reportTimeStr(d.CreatedAt), reportTimeStr(d.UpdatedAt))
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	d.ID = int(id)
+	return nil
+}
+
+func (d *deadLetter) update(ctx context.Context) error {
+	d.UpdatedAt = time.Now()
+	sql := fmt.Sprintf(`UPDATE %s SET error=?, attempts=?, replayed=?, updated_at=? WHERE id=?`, d.TableName())
+	_, err := dbExec(ctx, sql, d.Error, d.Attempts, d.Replayed, reportTimeStr(d.UpdatedAt), d.ID)
+	return err
+}
+
+func (d *deadLetter) job() (job, error) {
+	a, err := accountByID(d.AccountID)
+	if err != nil {
+		return job{}, err
+	}
+
+	j := job{
+		from:    d.FromTime,
+		to:      d.ToTime,
+		offset:  d.Offset,
+		limit:   d.Limit,
+		account: a,
+	}
+	return j, nil
+}
+
+// findDeadLetters returns failed pages, pending ones only if all is false
+func findDeadLetters(all bool) ([]deadLetter, error) {
+	var list []deadLetter
+
+	qs := MysqlORM.QueryTable(new(deadLetter))
+	if !all {
+		qs = qs.Filter("replayed", 0)
+	}
+	_, err := qs.OrderBy("id").All(&list)
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// replayDeadLetters fetches pending failed pages again and saves them as a
+// normal page. It returns the number of replayed pages
+func (sch *scheduler) replayDeadLetters() (int, error) {
+	var replayed int
+
+	list, err := findDeadLetters(false)
+	if err != nil {
+		return 0, err
+	}
+	run := newRunID("replay")
+
+	for i := range list {
+		d := &list[i]
+		j, err := d.job()
+		if err != nil {
+			logErrorf("replay dead letter id=%d %v", d.ID, err)
+			continue
+		}
+
+		j.run = run
+		sch.mutex.Lock()
+		w := newFetchWorker(j, sch)
+		sch.mutex.Unlock()
+		// only the items of the dead letter are replayed, keep its limit
+		w.pageSize = pageSize{Min: j.limit, Max: j.limit}
+
+		page, err := w.fetchPage(sch.ctx)
+		if err == nil {
+			err, _ = w.finishPage(page)
+		}
+
+		if err != nil {
+			logErrorf("replay %s %v", w.currJob.String(), err)
+			d.Error = redactedError(err)
+			if pageErr, ok := err.(*pageError); ok {
+				d.Attempts += pageErr.attempts
+			}
+		} else {
+			d.Replayed = 1
+			replayed++
+		}
+
+		err = d.update(sch.ctx)
+		if err != nil {
+			return replayed, err
+		}
+	}
+
+	return replayed, nil
+}
+
+func printDeadLetters(list []deadLetter) {
+	fmt.Printf("ID \t From \t To \t Offset \t Limit \t Attempts \t Replayed \t Error \n")
+	for _, d := range list {
+		fmt.Printf("%d \t %s \t %s \t %d \t %d \t %d \t %d \t %s \n", d.ID, reportTimeStr(d.FromTime),
+			reportTimeStr(d.ToTime), d.Offset, d.Limit, d.Attempts, d.Replayed, d.Error)
+	}
+}
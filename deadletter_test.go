@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDeadLetter(t *testing.T) {
+	fromTime, _ := strToTimeNoT("2017-02-13 00:00:00")
+	toTime, _ := strToTimeNoT("2017-02-13 23:59:59")
+	j := job{from: fromTime, to: toTime, offset: 300, limit: 100, account: flagAccount()}
+
+	err := &pageError{err: &HTTPError{StatusCode: 502}, class: errClassRetry, attempts: 5}
+	d := newDeadLetter(j, err)
+	assert.Equal(t, 5, d.Attempts)
+	assert.Equal(t, err.Error(), d.Error)
+	dj, err2 := d.job()
+	assert.NoError(t, err2)
+	assert.Equal(t, j.offset, dj.offset)
+	assert.Equal(t, j.limit, dj.limit)
+
+	d = newDeadLetter(j, errors.New("broken"))
+	assert.Equal(t, 1, d.Attempts)
+}
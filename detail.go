@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+)
+
+// conversionDetail keeps the fields of conversion_data which are not in the
+// monthly conversion tables
+type conversionDetail struct {
+	ID             int       `orm:"column(id);pk;auto"`
+	ConversionID   string    `orm:"column(conversion_id)"`
+	ConversionTime time.Time `orm:"column(conversion_time);type(timestamp)"`
+	CampaignID     string    `orm:"column(campaign_id)"`
+	Currency       string    `orm:"column(currency)"`
+	Country        string    `orm:"column(country)"`
+	Device         string    `orm:"column(device)"`
+	CustomerType   string    `orm:"column(customer_type)"`
+	RefererIP      string    `orm:"column(referer_ip)"`
+	SourceReferer  string    `orm:"column(source_referer)"`
+	ClickType      string    `orm:"column(click_type)"`
+	ClickStatus    string    `orm:"column(click_status)"`
+	ClickTime      string    `orm:"column(click_time)"`
+	ClickIP        string    `orm:"column(click_ip)"`
+	ClickReferer   string    `orm:"column(click_referer)"`
+	UserAgent      string    `orm:"column(user_agent)"`
+	MetaData       string    `orm:"column(meta_data)"` // json
+}
+
+func (d *conversionDetail) TableName() string {
+	return "affi_conversion_detail"
+}
+
+func (c *conversionData) toDetail(t time.Time) *conversionDetail {
+	d := &conversionDetail{
+		ConversionID:   c.ID,
+		ConversionTime: t,
+		CampaignID:     c.CampaignID,
+		Currency:       c.Currency,
+		Country:        c.Country,
+		Device:         c.Device,
+		CustomerType:   c.CustomerType,
+		RefererIP:      c.RefererIP,
+		SourceReferer:  c.SourceReferer,
+		ClickType:      c.Click.Type,
+		ClickStatus:    c.Click.Status,
+		ClickTime:      c.Click.SetTime,
+		ClickIP:        c.Click.SetIP,
+		ClickReferer:   c.Click.Referer,
+		UserAgent:      c.Click.UserAgent,
+		MetaData:       string(c.MetaData),
+	}
+	return d
+}
+
+func (d *conversionDetail) upsert(ctx context.Context) error {
+	sql := `INSERT INTO %s (conversion_id, conversion_time, campaign_id, currency, country, device,
+    customer_type, referer_ip, source_referer, click_type, click_status, click_time, click_ip,
+    click_referer, user_agent, meta_data)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    ON DUPLICATE KEY UPDATE campaign_id=VALUES(campaign_id), currency=VALUES(currency),
+    country=VALUES(country), device=VALUES(device), customer_type=VALUES(customer_type),
+    referer_ip=VALUES(referer_ip), source_referer=VALUES(source_referer), click_type=VALUES(click_type),
+    click_status=VALUES(click_status), click_time=VALUES(click_time), click_ip=VALUES(click_ip),
+    click_referer=VALUES(click_referer), user_agent=VALUES(user_agent), meta_data=VALUES(meta_data)`
+	sql = fmt.Sprintf(sql, d.TableName())
+
+	_, err := dbExec(ctx, sql, d.ConversionID, reportTimeStr(d.ConversionTime),
+		d.CampaignID, d.Currency, d.Country, d.Device, d.CustomerType, d.RefererIP, d.SourceReferer,
+		d.ClickType, d.ClickStatus, d.ClickTime, d.ClickIP, d.ClickReferer, d.UserAgent, d.MetaData)
+	return err
+}
+
+// revenueRow is the revenue of one country or device
+type revenueRow struct {
+	Key                 string  `json:"key"`
+	ConversionNum       int     `json:"conversion_num"`
+	ConversionValue     float64 `json:"conversion_value"`
+	PublisherCommission float64 `json:"publisher_commission"`
+}
+
+var revenueColumns = map[string]string{
+	"country": "d.country",
+	"device":  "d.device",
+}
+
+// revenueBy sums conversions in [from, to) grouped by country or device. The
+// months without a table have no conversions
+func revenueBy(by string, from, to time.Time) ([]revenueRow, error) {
+	column, ok := revenueColumns[by]
+	if !ok {
+		return nil, fmt.Errorf("can not group by %s", by)
+	}
+
+	tables, err := existingTables(convTableNames(from, to))
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]*revenueRow)
+	for _, table := range tables {
+		var rows []revenueRow
+
+		sql := `select %s as ` + "`key`" + `, count(*) as conversion_num, sum(c.conversion_value) as conversion_value,
+        sum(c.publisher_commission) as publisher_commission
+        from %s c join affi_conversion_detail d on c.conversion_id = d.conversion_id
+        where c.conversion_time >= ? and c.conversion_time < ? group by %s`
+		sql = fmt.Sprintf(sql, column, table, column)
+
+		_, err := MysqlORM.Raw(sql, reportTimeStr(from), reportTimeStr(to)).QueryRows(&rows)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range rows {
+			sum, ok := sums[row.Key]
+			if !ok {
+				sum = &revenueRow{Key: row.Key}
+				sums[row.Key] = sum
+			}
+			sum.ConversionNum += row.ConversionNum
+			sum.ConversionValue += row.ConversionValue
+			sum.PublisherCommission += row.PublisherCommission
+		}
+	}
+
+	result := make([]revenueRow, 0, len(sums))
+	for _, sum := range sums {
+		result = append(result, *sum)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ConversionValue > result[j].ConversionValue
+	})
+
+	return result, nil
+}
+
+// existingTables returns the tables of names which are in the database, in
+// the same order
+func existingTables(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		args[i] = name
+	}
+	sql := `select table_name from information_schema.tables where table_schema = database()
+    and table_name in (?` + strings.Repeat(", ?", len(names)-1) + `)`
+
+	var list orm.ParamsList
+	_, err := MysqlORM.Raw(sql, args...).ValuesFlat(&list)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool, len(list))
+	for _, name := range list {
+		found[fmt.Sprint(name)] = true
+	}
+
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		if found[name] {
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
+// convTableNames returns the monthly tables covering [from, to)
+func convTableNames(from, to time.Time) []string {
+	var names []string
+
+	from = from.In(reportLoc)
+	month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, reportLoc)
+	for month.Before(to) {
+		names = append(names, getConvTableNameByTime(month))
+		month = month.AddDate(0, 1, 0)
+	}
+
+	return names
+}
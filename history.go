@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// statusHistory is a change of status or value of a conversion
+type statusHistory struct {
+	ID             int       `orm:"column(id);pk;auto" json:"id"`
+	ConversionID   string    `orm:"column(conversion_id)" json:"conversion_id"`
+	ConversionTime time.Time `orm:"column(conversion_time);type(timestamp)" json:"conversion_time"`
+	OldStatus      string    `orm:"column(old_status)" json:"old_status"`
+	NewStatus      string    `orm:"column(new_status)" json:"new_status"`
+	OldValue       float32   `orm:"column(old_value)" json:"old_value"`
+	NewValue       float32   `orm:"column(new_value)" json:"new_value"`
+	Run            string    `orm:"column(run)" json:"run"` // fetch run which observed the change
+	CreatedAt      time.Time `orm:"column(created_at);type(timestamp)" json:"created_at"`
+}
+
+func (h *statusHistory) TableName() string {
+	return "affi_conversion_status_history"
+}
+
+// newStatusHistory records the change from the saved conversion old to the fetched one
+func newStatusHistory(old, fetched *conversion, run string) *statusHistory {
+	h := &statusHistory{
+		ConversionID:   fetched.ConversionID,
+		ConversionTime: fetched.ConversionTime,
+		OldStatus:      old.ConversionStatus,
+		NewStatus:      fetched.ConversionStatus,
+		OldValue:       old.ConversionValue,
+		NewValue:       fetched.ConversionValue,
+		Run:            run,
+		CreatedAt:      time.Now(),
+	}
+	return h
+}
+
+func (h *statusHistory) insert(ctx context.Context, tx execer) error {
+	sql := `INSERT INTO %s (conversion_id, conversion_time, old_status, new_status, old_value, new_value,
+    run, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	sql = fmt.Sprintf(sql, h.TableName())
+
+	_, err := tx.ExecContext(ctx, sql, h.ConversionID, reportTimeStr(h.ConversionTime), h.OldStatus, h.NewStatus,
+		h.OldValue, h.NewValue, h.Run, reportTimeStr(h.CreatedAt))
+	return err
+}
+
+func findStatusHistory(conversionID string) ([]statusHistory, error) {
+	var list []statusHistory
+	_, err := MysqlORM.QueryTable(new(statusHistory)).Filter("conversion_id", conversionID).OrderBy("id").All(&list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// newRunID names a fetch run, for example fetch-20170213101500
+func newRunID(kind string) string {
+	return kind + "-" + time.Now().Format("20060102150405")
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -63,33 +66,90 @@ func NewReqeustConfig(params, headers map[string]string, timeout uint16, body []
 	return config
 }
 
+// withTimeout bounds ctx by the timeout of the request, in second. The client
+// is shared by all workers, so its own Timeout is never set
+func (config *RequestConfig) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if config.Timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(config.Timeout)*time.Second)
+}
+
+// HTTPError is returned for non-200 responses
+type HTTPError struct {
+	StatusCode int
+	// RetryAfter is parsed from the Retry-After header of 429 and 503 responses
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("resp code is %d", e.StatusCode)
+}
+
+// Throttled tells if the server asks the client to slow down
+func (e *HTTPError) Throttled() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+}
+
+func newHTTPError(res *http.Response) *HTTPError {
+	e := &HTTPError{StatusCode: res.StatusCode}
+	if e.Throttled() {
+		e.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+	}
+	return e
+}
+
+// parseRetryAfter parses Retry-After in seconds or in http date
+func parseRetryAfter(val string, now time.Time) time.Duration {
+	if val == "" {
+		return 0
+	}
+
+	if sec, err := strconv.Atoi(val); err == nil {
+		if sec < 0 {
+			return 0
+		}
+		return time.Duration(sec) * time.Second
+	}
+
+	if t, err := http.ParseTime(val); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return 0
+}
+
 // HTTPGet returns http response body in []byte, timeout in second
 func HTTPGet(url string, config *RequestConfig) ([]byte, int, error) {
+	return HTTPGetContext(context.Background(), url, config)
+}
+
+// HTTPGetContext is HTTPGet which is aborted when ctx is done
+func HTTPGetContext(ctx context.Context, url string, config *RequestConfig) ([]byte, int, error) {
 	req, err := NewHTTPReqeust("GET", url, config.Params, config.Headers, nil)
 	if err != nil {
 		return nil, 0, err
 	}
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+	req = req.WithContext(ctx)
 
 	client := http.DefaultClient
 	if config.Client != nil {
 		client = config.Client
 	}
 
-	if config.Timeout > 0 {
-		client.Timeout = time.Duration(config.Timeout) * time.Second
-	}
-
-	res, err := client.Do(req)
+	res, err := doRequest(client, req)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return nil, res.StatusCode, fmt.Errorf("resp code is %d", res.StatusCode)
+		return nil, res.StatusCode, newHTTPError(res)
 	}
 
 	b, err := ioutil.ReadAll(res.Body)
-	defer res.Body.Close()
 
 	if err != nil {
 
@@ -99,8 +159,111 @@ func HTTPGet(url string, config *RequestConfig) ([]byte, int, error) {
 	return b, res.StatusCode, nil
 }
 
+// HTTPGetStream hands the body of a 200 response to fn as it is read, instead
+// of reading it into memory first. It is aborted when ctx is done. The timeout,
+// in second, is for the server only: to connect and send the headers, then for
+// each read of the body, not for the time fn spends between reads
+func HTTPGetStream(ctx context.Context, url string, config *RequestConfig, fn func(body io.Reader) error) (int, error) {
+	req, err := NewHTTPReqeust("GET", url, config.Params, config.Headers, nil)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	client := http.DefaultClient
+	if config.Client != nil {
+		client = config.Client
+	}
+
+	deadline := newIdleDeadline(time.Duration(config.Timeout)*time.Second, cancel)
+	res, err := doRequest(client, req)
+	deadline.stop()
+	if err != nil {
+		return 0, deadline.err(err)
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, newHTTPError(res)
+	}
+
+	return res.StatusCode, deadline.err(fn(&idleReader{r: res.Body, deadline: deadline}))
+}
+
+// idleDeadline cancels a request when the server is silent for longer than
+// timeout. It runs only while the request waits for the server
+type idleDeadline struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   int32
+}
+
+func newIdleDeadline(timeout time.Duration, cancel context.CancelFunc) *idleDeadline {
+	d := &idleDeadline{timeout: timeout}
+	if timeout > 0 {
+		d.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&d.fired, 1)
+			cancel()
+		})
+	}
+	return d
+}
+
+func (d *idleDeadline) start() {
+	if d.timer != nil {
+		d.timer.Reset(d.timeout)
+	}
+}
+
+func (d *idleDeadline) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+// err is a timeout error if the deadline canceled the request
+func (d *idleDeadline) err(err error) error {
+	if err != nil && atomic.LoadInt32(&d.fired) == 1 {
+		return &idleTimeoutError{timeout: d.timeout}
+	}
+	return err
+}
+
+// idleReader runs the deadline during each read of the body
+type idleReader struct {
+	r        io.Reader
+	deadline *idleDeadline
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.deadline.start()
+	n, err := r.r.Read(p)
+	r.deadline.stop()
+	return n, err
+}
+
+// idleTimeoutError is a net.Error, so the page size shrinks after it like after
+// the timeout of a client
+type idleTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *idleTimeoutError) Error() string {
+	return fmt.Sprintf("no response from the server for %s", e.timeout)
+}
+
+func (e *idleTimeoutError) Timeout() bool   { return true }
+func (e *idleTimeoutError) Temporary() bool { return true }
+
 // HTTPGetFile store body in single file, return file and file's content type
 func HTTPGetFile(url string, config *RequestConfig) (outFName, contentType string, contentLength int64, err error) {
+	return HTTPGetFileContext(context.Background(), url, config)
+}
+
+// HTTPGetFileContext is HTTPGetFile which is aborted when ctx is done
+func HTTPGetFileContext(ctx context.Context, url string, config *RequestConfig) (outFName, contentType string, contentLength int64, err error) {
 	tmpFp, err := ioutil.TempFile("", "dl")
 	if err != nil {
 		return
@@ -112,19 +275,22 @@ func HTTPGetFile(url string, config *RequestConfig) (outFName, contentType strin
 	if err != nil {
 		return
 	}
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+	req = req.WithContext(ctx)
 
 	client := http.DefaultClient
 	if config.Client != nil {
 		client = config.Client
 	}
-	client.Timeout = time.Duration(config.Timeout) * time.Second
 
-	res, err := client.Do(req)
+	res, err := doRequest(client, req)
 	if err != nil {
 		return
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("resp code is %d", res.StatusCode)
+		err = newHTTPError(res)
 		return
 	}
 
@@ -132,7 +298,6 @@ func HTTPGetFile(url string, config *RequestConfig) (outFName, contentType strin
 	contentLength, _ = strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
 
 	reader := bufio.NewReader(res.Body)
-	defer res.Body.Close()
 
 	_, err = reader.WriteTo(tmpFp)
 	if err != nil {
@@ -148,12 +313,14 @@ func HTTPPost(url string, config *RequestConfig) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	ctx, cancel := config.withTimeout(context.Background())
+	defer cancel()
+	req = req.WithContext(ctx)
 
 	client := http.DefaultClient
 	if config.Client != nil {
 		client = config.Client
 	}
-	client.Timeout = time.Duration(config.Timeout) * time.Second
 
 	res, err := client.Do(req)
 	if err != nil {
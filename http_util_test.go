@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPGetContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// never answers, like a stuck API
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := HTTPGetStream(ctx, server.URL, NewReqeustConfig(nil, nil, 90, nil, nil), func(body io.Reader) error {
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, context.Canceled, ctx.Err())
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	_, _, err = HTTPGetContext(ctx, server.URL, NewReqeustConfig(nil, nil, 90, nil, nil))
+	assert.Error(t, err)
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("stuck") != "" {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	_, _, err := HTTPGetContext(context.Background(), server.URL, NewReqeustConfig(map[string]string{"stuck": "1"}, nil, 1, nil, nil))
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	// requests with their own timeouts at once, go test -race tells if they
+	// share state
+	var wg sync.WaitGroup
+	for i := 1; i <= 4; i++ {
+		wg.Add(1)
+		go func(timeout uint16) {
+			defer wg.Done()
+			_, err := HTTPGetStream(context.Background(), server.URL, NewReqeustConfig(nil, nil, timeout, nil, nil), func(body io.Reader) error {
+				_, err := ioutil.ReadAll(body)
+				return err
+			})
+			assert.NoError(t, err)
+		}(uint16(i * 30))
+	}
+	wg.Wait()
+}
+
+func TestHTTPGetStreamIdle(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		if r.URL.Query().Get("stall") != "" {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("second"))
+	}))
+	defer server.Close()
+
+	// a slow reader, like a slow database under the decoder, is not a timeout
+	var body []byte
+	_, err := HTTPGetStream(context.Background(), server.URL, NewReqeustConfig(nil, nil, 1, nil, nil), func(r io.Reader) error {
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(r, buf)
+		if err != nil {
+			return err
+		}
+		time.Sleep(1500 * time.Millisecond)
+		rest, err := ioutil.ReadAll(r)
+		body = append(buf, rest...)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "firstsecond", string(body))
+
+	// a silent server is
+	_, err = HTTPGetStream(context.Background(), server.URL, NewReqeustConfig(map[string]string{"stall": "1"}, nil, 1, nil, nil), func(r io.Reader) error {
+		_, err := ioutil.ReadAll(r)
+		return err
+	})
+	assert.Error(t, err)
+	assert.True(t, isSlowError(err))
+}
@@ -1,20 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"fmt"
 	"io"
 	"sync"
 	"time"
 
-	"net/url"
-
 	"os"
 	"path/filepath"
 
 	"strconv"
-
-	"github.com/golang/glog"
 )
 
 const (
@@ -35,8 +32,10 @@ type importer struct {
 	jobNum int      // current job number
 	jobs   chan int // chan of applePayment ID
 	mutex  sync.Mutex
-	csvDir string
-	errs   errorList
+	// applePayment IDs queued or being imported
+	pending map[int]bool
+	csvDir  string
+	errs    errorList
 }
 
 type errorList struct {
@@ -45,7 +44,8 @@ type errorList struct {
 }
 
 type applePayment struct {
-	ID           int     `orm:"column(id);pk"`
+	ID           int     `orm:"column(id);pk;auto"`
+	AccountID    int     `orm:"column(account_id)"` // 0 means the first account
 	Reference    string  `orm:"column(reference)"`
 	CsvFile      string  `orm:"column(csv_file)"`
 	Imported     int     `orm:"column(imported)"` // 0 not start, 1 running, 2 done
@@ -63,6 +63,11 @@ func (a *applePayment) updateStatus() error {
 	return err
 }
 
+func (a *applePayment) insert() error {
+	_, err := MysqlORM.Insert(a)
+	return err
+}
+
 func findApplePaymentByID(id int) (applePayment, error) {
 	p := applePayment{ID: id}
 	err := MysqlORM.Read(&p)
@@ -72,6 +77,26 @@ func findApplePaymentByID(id int) (applePayment, error) {
 	return p, nil
 }
 
+func findApplePaymentByReference(reference string) (applePayment, error) {
+	p := applePayment{Reference: reference}
+	err := MysqlORM.Read(&p, "Reference")
+	if err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// findReadyApplePayments returns payments not imported yet, with exchange rate and paid amount
+func findReadyApplePayments() ([]applePayment, error) {
+	var list []applePayment
+	_, err := MysqlORM.QueryTable(new(applePayment)).Filter("imported", notImported).
+		Filter("exchange_rate__gt", 0).Filter("paid_amount__gt", 0).OrderBy("id").All(&list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
 // csv 中的单行数据结构
 type appleConv struct {
 	ConvID          string
@@ -98,14 +123,14 @@ func udpateConvByApple(conv appleConv, reference string) error {
 	if err == nil && result != nil {
 		num, err = result.RowsAffected()
 	} else {
-		glog.Errorf("%#v, time=%s convID=%s", err, conv.ConvTime.Format(time.RFC3339), conv.ConvID)
+		logErrorf("%#v, time=%s convID=%s", err, conv.ConvTime.Format(time.RFC3339), conv.ConvID)
 		return err
 	}
 
 	if num == 0 {
-		_, err = findByConversionID(conv.ConvTime, conv.ConvID)
+		_, err = findByConversionID(context.Background(), conv.ConvTime, conv.ConvID)
 		if err != nil {
-			glog.Errorf("NotFound time=%s convID=%s file=%s", conv.ConvTime.Format(time.RFC3339), conv.ConvID, reference)
+			logErrorf("NotFound time=%s convID=%s file=%s", conv.ConvTime.Format(time.RFC3339), conv.ConvID, reference)
 			ipt.errs.setError(conv.ConvTime, fmt.Sprintf("ID=%s, Ref=%s", conv.ConvID, reference))
 		}
 	}
@@ -119,9 +144,10 @@ func newImporter(dir string) *importer {
 	}
 
 	i := &importer{
-		jobs:   make(chan int, maxJobQueue),
-		mutex:  sync.Mutex{},
-		csvDir: dir,
+		jobs:    make(chan int, maxJobQueue),
+		mutex:   sync.Mutex{},
+		pending: make(map[int]bool),
+		csvDir:  dir,
 		errs: errorList{
 			list: make(map[time.Time]string),
 			mut:  sync.Mutex{},
@@ -130,75 +156,108 @@ func newImporter(dir string) *importer {
 	return i
 }
 
+// addJob queues the payment, unless it is queued or being imported already
 func (i *importer) addJob(id int) error {
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
 
+	if i.pending[id] {
+		return nil
+	}
 	if i.jobNum >= maxJobQueue {
 		return fmt.Errorf("too many jobs")
 	}
 	i.jobNum++
+	i.pending[id] = true
 	i.jobs <- id
 
 	return nil
 }
 
-func (i *importer) Start() {
+// Start imports the queued payments until ctx is done
+func (i *importer) Start(ctx context.Context) {
 	for {
-		id := <-i.jobs
+		var id int
+		select {
+		case id = <-i.jobs:
+		case <-ctx.Done():
+			return
+		}
 		// decreate jobNum
 		i.mutex.Lock()
 		i.jobNum--
 		i.mutex.Unlock()
 
-		applePay, err := findApplePaymentByID(id)
+		err := i.importPayment(ctx, id)
 		if err != nil {
-			glog.Error(err)
-			return
+			logErrorf("apple payment id=%d %v", id, err)
 		}
 
-		if applePay.Imported != 0 || applePay.PaidAmount == 0 || applePay.ExchangeRate == 0 {
-			glog.Error("applePay.PaidAmount is 0 or it has been imported, %v", applePay)
-			continue
-		}
+		i.mutex.Lock()
+		delete(i.pending, id)
+		i.mutex.Unlock()
+	}
+}
 
-		fmt.Println("update status 1...")
-		applePay.Imported = importing
-		err = applePay.updateStatus()
-		if err != nil {
-			glog.Error(err)
-			return
-		}
+// importPayment downloads the csv of the payment and updates its conversions.
+// On failure the payment goes back to notImported, so it can be imported again
+func (i *importer) importPayment(ctx context.Context, id int) error {
+	applePay, err := findApplePaymentByID(id)
+	if err != nil {
+		return err
+	}
 
-		fmt.Println("preparing...")
-		err = i.prepareJob(applePay)
-		if err != nil {
-			glog.Error(err)
-			return
-		}
+	if applePay.Imported != 0 || applePay.PaidAmount == 0 || applePay.ExchangeRate == 0 {
+		logErrorf("applePay.PaidAmount is 0 or it has been imported, %v", applePay)
+		return nil
+	}
 
-		fmt.Println("handling csv...")
-		err = i.handleCsv(applePay)
-		if err != nil {
-			glog.Error(err)
-			return
-		}
+	fmt.Println("update status 1...")
+	applePay.Imported = importing
+	err = applePay.updateStatus()
+	if err != nil {
+		return err
+	}
 
-		fmt.Println("update status 2...")
-		applePay.Imported = imported
-		err = applePay.updateStatus()
-		if err != nil {
-			glog.Error(err)
-			return
+	err = i.importCsv(ctx, applePay)
+	if err != nil {
+		applePay.Imported = notImported
+		if resetErr := applePay.updateStatus(); resetErr != nil {
+			logErrorf("apple payment id=%d reset status %v", id, resetErr)
 		}
+		return err
 	}
+
+	return nil
 }
 
-func (i *importer) prepareJob(applePay applePayment) error {
+func (i *importer) importCsv(ctx context.Context, applePay applePayment) error {
+	fmt.Println("preparing...")
+	err := i.prepareJob(ctx, applePay)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("handling csv...")
+	err = i.handleCsv(applePay)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("update status 2...")
+	applePay.Imported = imported
+	return applePay.updateStatus()
+}
+
+func (i *importer) prepareJob(ctx context.Context, applePay applePayment) error {
+	a, err := accountByID(applePay.AccountID)
+	if err != nil {
+		return err
+	}
+
 	// download file
-	url := addAuthToURL(applePay.CsvFile, appKey, apiKey)
-	config := NewReqeustConfig(nil, nil, 600, nil, nil)
-	tmpFile, _, _, err := HTTPGetFile(url, config)
+	config := NewReqeustConfig(nil, a.authHeader(), 600, nil, nil)
+	tmpFile, _, _, err := HTTPGetFileContext(ctx, applePay.CsvFile, config)
 	if err != nil {
 		return err
 	}
@@ -247,20 +306,21 @@ func (i *importer) handleCsv(applePay applePayment) error {
 		}
 
 		timeStr := record[IndexConvTime]
-		time, err := strToTimeNoT(timeStr)
+		// the csv has the times of the API
+		time, err := strToTimeForConv(timeStr)
 		if err != nil {
-			glog.Error(err)
+			logError(err)
 			continue
 		}
 
 		amount, err := strconv.ParseFloat(record[IndexPublisherComm], 64)
 		if err != nil {
-			glog.Error(err)
+			logError(err)
 			continue
 		}
 		originConvValue, err := strconv.ParseFloat(record[IndexConvValue], 64)
 		if err != nil {
-			glog.Error(err)
+			logError(err)
 			continue
 		}
 
@@ -268,7 +328,7 @@ func (i *importer) handleCsv(applePay applePayment) error {
 		if record[IndexCurrency] != "USD" {
 			amountUSD = amount / applePay.ExchangeRate
 			if err != nil {
-				glog.Error(err)
+				logError(err)
 				continue
 			}
 		}
@@ -284,7 +344,7 @@ func (i *importer) handleCsv(applePay applePayment) error {
 
 		err = udpateConvByApple(conv, applePay.Reference)
 		if err != nil {
-			glog.Errorf("time=%s , convID=%s", timeStr, conv.ConvID)
+			logErrorf("time=%s , convID=%s", timeStr, conv.ConvID)
 		}
 
 	}
@@ -292,17 +352,6 @@ func (i *importer) handleCsv(applePay applePayment) error {
 	return nil
 }
 
-func addAuthToURL(URL, user, pwd string) string {
-	u, err := url.Parse(URL)
-	if err != nil {
-		glog.Error(err)
-		return URL
-	}
-
-	u.User = url.UserPassword(user, pwd)
-	return u.String()
-}
-
 func (e *errorList) setError(date time.Time, convID string) {
 	e.mut.Lock()
 	e.list[date] = convID
@@ -1,16 +1,16 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
 	"testing"
 )
 
 import "github.com/stretchr/testify/assert"
 
 func TestURL(t *testing.T) {
-	url := "https://itunes-api.performancehorizon.com/user/publisher/1010l19090/selfbill/S-1010l19090-1000l24697/items.csv"
-	url = addAuthToURL(url, "user", "pwd")
-	fmt.Println(url)
+	a := &account{AppKey: "user", APIKey: "pwd"}
+	assert.Equal(t, map[string]string{"Authorization": "Basic dXNlcjpwd2Q="}, a.authHeader())
 }
 
 func TestApplePayment(t *testing.T) {
@@ -21,7 +21,7 @@ func TestApplePayment(t *testing.T) {
 	i := newImporter("/tmp")
 	id := 3
 	apple, _ := findApplePaymentByID(id)
-	err := i.prepareJob(apple)
+	err := i.prepareJob(context.Background(), apple)
 	assert.NoError(t, err)
 	err = i.handleCsv(apple)
 	assert.NoError(t, err)
@@ -42,6 +42,35 @@ func TestPrecise(t *testing.T) {
 		OriginConvValue: 3.99,
 	}
 
-	err := udpateConvByApple(conv)
+	err := udpateConvByApple(conv, "")
 	assert.NoError(t, err)
 }
+
+func TestSelfBillList(t *testing.T) {
+	body := `{"selfbills":[{"selfbill":{"selfbill_id":"1000l24697","reference":"S-1010l19090-1000l24697","currency":"USD","total_value":120.5,"status":"paid"}}],
+	"hypermedia":{"pagination":{"next_page":"/user/publisher/1010l19090/selfbill.json?offset=1","total_item_count":2}}}`
+
+	var list selfBillList
+	err := json.Unmarshal([]byte(body), &list)
+	assert.NoError(t, err)
+	assert.Len(t, list.SelfBills, 1)
+	assert.Equal(t, "S-1010l19090-1000l24697", list.SelfBills[0].SelfBill.Reference)
+	assert.Equal(t, 120.5, list.SelfBills[0].SelfBill.TotalValue)
+	assert.NotEmpty(t, list.Hypermedia.Pagination.NextPage)
+}
+
+func TestAddJobPending(t *testing.T) {
+	i := newImporter("/tmp")
+
+	assert.NoError(t, i.addJob(3))
+	assert.NoError(t, i.addJob(3))
+	assert.Equal(t, 1, i.jobNum)
+	assert.Len(t, i.jobs, 1)
+
+	// done jobs can be queued again
+	<-i.jobs
+	i.jobNum--
+	delete(i.pending, 3)
+	assert.NoError(t, i.addJob(3))
+	assert.Equal(t, 1, i.jobNum)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by all workers, so that the total
+// request rate to the API stays under the limit whatever -go is
+type rateLimiter struct {
+	rate  float64 // tokens per second, 0 means unlimited
+	burst int
+
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	waiting     int
+	throttled   int
+	mutex       sync.Mutex
+}
+
+type limiterState struct {
+	Rate        float64 `json:"rate"`
+	Burst       int     `json:"burst"`
+	Tokens      float64 `json:"tokens"`
+	Waiting     int     `json:"waiting"`
+	Throttled   int     `json:"throttled"`
+	PausedUntil string  `json:"paused_until"`
+}
+
+func (s limiterState) String() string {
+	str := fmt.Sprintf("rate: %.1f/s burst: %d tokens: %.1f waiting: %d throttled: %d", s.Rate, s.Burst, s.Tokens, s.Waiting, s.Throttled)
+	if s.PausedUntil != "" {
+		str += " paused until " + s.PausedUntil
+	}
+	return str
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+
+	l := &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+		mutex:  sync.Mutex{},
+	}
+	return l
+}
+
+// Wait blocks until a request is allowed
+func (l *rateLimiter) Wait() {
+	l.WaitContext(context.Background())
+}
+
+// WaitContext blocks until a request is allowed or ctx is done
+func (l *rateLimiter) WaitContext(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+
+	l.mutex.Lock()
+	l.waiting++
+	l.mutex.Unlock()
+
+	defer func() {
+		l.mutex.Lock()
+		l.waiting--
+		l.mutex.Unlock()
+	}()
+
+	for {
+		d := l.reserve()
+		if d <= 0 {
+			return ctx.Err()
+		}
+		err := sleepContext(ctx, d)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// reserve takes a token if one is available, otherwise returns how long to wait
+func (l *rateLimiter) reserve() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.refill(now)
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+}
+
+// pause stops all workers for d, used when the API asks us to back off
+func (l *rateLimiter) pause(d time.Duration) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.throttled++
+	until := time.Now().Add(d)
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+func (l *rateLimiter) state() limiterState {
+	if l == nil {
+		return limiterState{}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if l.rate > 0 {
+		l.refill(now)
+	}
+
+	s := limiterState{
+		Rate:      l.rate,
+		Burst:     l.burst,
+		Tokens:    l.tokens,
+		Waiting:   l.waiting,
+		Throttled: l.throttled,
+	}
+	if now.Before(l.pausedUntil) {
+		s.PausedUntil = l.pausedUntil.Format("15:04:05")
+	}
+
+	return s
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(20, 2)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		l.Wait()
+	}
+	// 2 from burst, 2 more at 20/s
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+
+	l.pause(100 * time.Millisecond)
+	assert.NotEmpty(t, l.state().PausedUntil)
+	assert.Equal(t, 1, l.state().Throttled)
+
+	start = time.Now()
+	l.Wait()
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, 2*time.Minute, parseRetryAfter(now.Add(2*time.Minute).UTC().Format(http.TimeFormat), now.Truncate(time.Second)))
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
 )
 
 var (
@@ -15,7 +23,42 @@ var (
 	mysqlPwd  string
 	mysqlDB   string
 
-	isWeb bool
+	isWeb        bool
+	isDeadLetter bool
+	isReplay     bool
+	isReprocess  bool
+	isDaemon     bool
+	isQuarantine bool
+	isRerun      bool
+	isResume     bool
+
+	fixtureFile  string
+	accountNames string
+	currencyMode string
+	refRuleFile  string
+	cassetteDir  string
+	sourceTZ     string
+	reportTZ     string
+	cassetteMode string
+	secretsFile  string
+
+	selfBillInterval time.Duration
+	autoImport       bool
+
+	syncInterval time.Duration
+	syncOverlap  time.Duration
+
+	requestRate  float64
+	requestBurst int
+
+	minLimit int
+	maxLimit int
+
+	sliceSize time.Duration
+
+	retryNum      int
+	retryDelay    time.Duration
+	retryMaxDelay time.Duration
 
 	Scheduler *scheduler
 )
@@ -23,7 +66,7 @@ var (
 func init() {
 	flag.StringVar(&fromDateStr, "from", "", "for example: 2017-02-01 00:00:00")
 	flag.StringVar(&toDateStr, "to", "", "for example: 2017-02-02 00:00:00")
-	flag.IntVar(&jobNum, "go", 1, "goroutine number")
+	flag.IntVar(&jobNum, "go", 1, "workers for each account")
 
 	flag.StringVar(&mysqlHost, "host", "127.0.0.1", "mysql host")
 	flag.StringVar(&mysqlUser, "user", "root", "mysql user")
@@ -31,18 +74,107 @@ func init() {
 	flag.StringVar(&mysqlDB, "db", "fenda", "mysql db")
 
 	flag.BoolVar(&isWeb, "web", false, "use web interface")
+	flag.BoolVar(&isDeadLetter, "deadletter", false, "list pages which failed after retries")
+	flag.BoolVar(&isReplay, "replay", false, "fetch pending failed pages again")
+	flag.BoolVar(&isReprocess, "reprocess", false, "rebuild conversions from -from to -to out of raw data, without calling the API")
+	flag.Float64Var(&requestRate, "rate", 4, "max requests per second to the API of all workers, 0 means unlimited")
+	flag.IntVar(&requestBurst, "burst", 4, "max burst of requests to the API")
+	flag.IntVar(&minLimit, "minLimit", 50, "min page size, the page size halves on timeouts and 5xx")
+	flag.IntVar(&maxLimit, "maxLimit", 500, "max page size, the page size doubles after fast full pages")
+	flag.DurationVar(&sliceSize, "slice", defaultSliceSize, "length of the time slices a range is cut into, idle workers pull the next slice")
+	flag.IntVar(&retryNum, "retry", 5, "max attempts of fetching a page")
+	flag.DurationVar(&retryDelay, "retryDelay", time.Second, "backoff before the second attempt, doubled for each next attempt")
+	flag.DurationVar(&retryMaxDelay, "retryMaxDelay", time.Minute, "max backoff between attempts")
+	flag.BoolVar(&isQuarantine, "quarantine", false, "list conversions which can not be parsed")
+	flag.BoolVar(&isRerun, "rerunQuarantine", false, "parse and save pending quarantined conversions again")
+	flag.BoolVar(&isResume, "resume", false, "fetch the unfinished jobs of interrupted runs from their last checkpoint")
+	flag.BoolVar(&isDaemon, "daemon", false, "keep fetching from the saved watermark to now")
+	flag.DurationVar(&syncInterval, "interval", 10*time.Minute, "interval of fetching in daemon mode")
+	flag.DurationVar(&syncOverlap, "overlap", time.Hour, "fetch again this much before the watermark in daemon mode")
+	flag.DurationVar(&selfBillInterval, "selfbill", 0, "interval of looking for new self-bills in web mode, 0 means never")
+	flag.BoolVar(&autoImport, "autoImport", false, "import self-bills once exchange rate and paid amount are filled in")
+	flag.StringVar(&accountNames, "account", "", "comma separated names of accounts to fetch, all enabled accounts by default")
+	flag.StringVar(&currencyMode, "currency", currencyUSD, "usd: values converted by the API; native: local values converted with affi_exchange_rate; both: one more request for each page")
+	flag.StringVar(&refRuleFile, "refRules", "", "json file of publisher_reference parsing rules, u<uid>:<appid> and <uid>:<appid> by default")
+	flag.StringVar(&cassetteDir, "cassette", "", "directory of recorded API responses, credentials redacted")
+	flag.StringVar(&cassetteMode, "cassetteMode", cassetteReplay, "record: call the API and save responses to -cassette; replay: serve responses from -cassette only")
+	flag.StringVar(&sourceTZ, "sourceTZ", "UTC", "timezone of the times the API returns and takes")
+	flag.StringVar(&reportTZ, "reportTZ", "UTC", "timezone of monthly tables, pay_time_day, times in mysql and dates of -from, -to and the web API")
+	flag.StringVar(&secretsFile, "secrets", "", "json file of account credentials, {\"<account>\": {\"app_key\": ..., \"api_key\": ...}}, mode 600")
+	flag.StringVar(&fixtureFile, "fixture", "", "read conversions from a json file instead of the API")
 }
 
 func main() {
 	flag.Parse()
+	// errors may carry the DSN or a request URL
+	log.SetOutput(redactWriter{os.Stderr})
+	err := loadTimezones(sourceTZ, reportTZ)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if secretsFile != "" {
+		accountSecrets, err = loadSecrets(secretsFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if appKey != "" || apiKey != "" {
+		glog.Warningf("-appKey and -apiKey are visible in ps, use %s and %s or -secrets", envAppKey, envAPIKey)
+	}
+	registerSecret(mysqlPwd)
 	InitDB(mysqlHost, mysqlUser, mysqlPwd, mysqlDB)
-	Scheduler = newScheduler(jobNum)
-	Scheduler.createWorker(jobNum)
+	if refRuleFile != "" {
+		p, err := loadRefParser(refRuleFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		refParser = p
+	}
+	if cassetteDir != "" {
+		c, err := newCassette(cassetteDir, cassetteMode)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		httpCassette = c
+	}
+	limiter := newRateLimiter(requestRate, requestBurst)
+	source, err := newConversionSource(limiter)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	accounts, err = loadAccounts(context.Background(), splitAccountNames(accountNames))
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-	if !isWeb {
-		startCmd()
-	} else {
+	// jobNum workers for each account
+	Scheduler = newScheduler(jobNum*len(accounts), source, limiter)
+	Scheduler.retry = cliRetryPolicy()
+	Scheduler.pageSize = pageSize{Min: minLimit, Max: maxLimit}.withDefaults()
+	// the daemon goes on from its watermark, so its windows need no checkpoints
+	Scheduler.checkpoints = !isDaemon
+	Scheduler.createWorker(jobNum * len(accounts))
+	go stopOnSignal()
+
+	switch {
+	case isWeb:
 		startWeb()
+	case isDeadLetter:
+		listDeadLetters()
+	case isReplay:
+		replayDeadLetters()
+	case isReprocess:
+		startReprocess()
+	case isDaemon:
+		startDaemon()
+	case isQuarantine:
+		listQuarantines()
+	case isRerun:
+		rerunQuarantine()
+	case isResume:
+		startResume()
+	default:
+		startCmd()
 	}
 }
 
@@ -53,7 +185,7 @@ func startCmd() {
 		log.Fatalln(err)
 	}
 
-	jobs, err := seperateJobs(fromTime, toTime, jobNum)
+	jobs, err := sliceAccountJobs(accounts, fromTime, toTime, sliceSize)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -62,3 +194,125 @@ func startCmd() {
 	//Scheduler.printProcess()
 	Scheduler.printProcessWithUI()
 }
+
+func listDeadLetters() {
+	list, err := findDeadLetters(true)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	printDeadLetters(list)
+}
+
+func replayDeadLetters() {
+	num, err := Scheduler.replayDeadLetters()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("replayed: %d \n", num)
+}
+
+func startReprocess() {
+	fromTime, err := strToTime(fromDateStr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	toTime, err := strToTime(toDateStr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	readNum, savedNum, failedNum, err := reprocessRaw(Scheduler.ctx, fromTime, toTime, newDBRates())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("total: %d , total save: %d , failed: %d \n", readNum, savedNum, failedNum)
+}
+
+func listQuarantines() {
+	list, err := findQuarantines(true)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	printQuarantines(list)
+}
+
+func rerunQuarantine() {
+	num, err := rerunQuarantines(Scheduler.ctx, newDBRates())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("saved: %d \n", num)
+}
+
+func startResume() {
+	num, err := Scheduler.resumeJobs()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if num == 0 {
+		fmt.Println("no unfinished job")
+		return
+	}
+
+	Scheduler.printProcessWithUI()
+}
+
+func startDaemon() {
+	// without a watermark, start from -from or one overlap ago
+	initFrom := time.Now().UTC().Add(-syncOverlap)
+	if fromDateStr != "" {
+		t, err := strToTime(fromDateStr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		initFrom = t
+	}
+
+	s := &syncer{
+		sch:      Scheduler,
+		accounts: accounts,
+		interval: syncInterval,
+		overlap:  syncOverlap,
+		initFrom: initFrom,
+	}
+	s.Start()
+}
+
+// newConversionSource returns the source of -fixture or the API. The API
+// source takes a token of limiter for each request it makes beyond the first
+// one of a page
+func newConversionSource(limiter *rateLimiter) (ConversionSource, error) {
+	if fixtureFile != "" {
+		return newFileSource(fixtureFile)
+	}
+	switch currencyMode {
+	case currencyUSD, currencyNative, currencyBoth:
+	default:
+		return nil, fmt.Errorf("unknown currency mode %s", currencyMode)
+	}
+	return newPHSource(currencyMode, newDBRates(), limiter), nil
+}
+
+func cliRetryPolicy() retryPolicy {
+	p := retryPolicy{
+		MaxAttempts: retryNum,
+		BaseDelay:   retryDelay,
+		MaxDelay:    retryMaxDelay,
+	}
+	return p.withDefaults()
+}
+
+// stopOnSignal aborts all jobs with their in-flight requests and queries on
+// SIGINT or SIGTERM, and exits once the workers stopped
+func stopOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+
+	glog.Info("shutting down")
+	Scheduler.shutdown()
+	Scheduler.wait()
+	Scheduler.closeUI()
+	glog.Flush()
+	os.Exit(1)
+}
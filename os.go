@@ -8,8 +8,6 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-
-	"github.com/golang/glog"
 )
 
 // FileExists checks if file exists
@@ -96,7 +94,7 @@ func Unzip(src, dest string) error {
 	}
 	defer func() {
 		if err := r.Close(); err != nil {
-			glog.Error(err)
+			logError(err)
 		}
 	}()
 
@@ -120,7 +118,7 @@ func extractAndWriteFile(f *zip.File, dest string) error {
 	}
 	defer func() {
 		if err := rc.Close(); err != nil {
-			glog.Error(err)
+			logError(err)
 		}
 	}()
 
@@ -136,7 +134,7 @@ func extractAndWriteFile(f *zip.File, dest string) error {
 		}
 		defer func() {
 			if err := f.Close(); err != nil {
-				glog.Error(err)
+				logError(err)
 			}
 		}()
 
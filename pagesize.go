@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// a full page faster than this grows the page size
+	fastPageTime = 5 * time.Second
+)
+
+// pageSize bounds the limit of jobs. The limit doubles after a fast full
+// page and halves after a timeout or 5xx, Min == Max keeps it fixed
+type pageSize struct {
+	Min int
+	Max int
+}
+
+func (p pageSize) withDefaults() pageSize {
+	if p.Min <= 0 {
+		p.Min = limit
+	}
+	if p.Max < p.Min {
+		p.Max = p.Min
+	}
+	return p
+}
+
+func (p pageSize) clamp(n int) int {
+	if n < p.Min {
+		return p.Min
+	}
+	if n > p.Max {
+		return p.Max
+	}
+	return n
+}
+
+// afterPage is the limit of the next page, after a page of items with n limit
+// took elapsed
+func (p pageSize) afterPage(n, items int, elapsed time.Duration) int {
+	if items >= n && elapsed < fastPageTime {
+		return p.clamp(n * 2)
+	}
+	return p.clamp(n)
+}
+
+// afterError is the limit to retry with after err
+func (p pageSize) afterError(n int, err error) int {
+	if isSlowError(err) {
+		return p.clamp(n / 2)
+	}
+	return p.clamp(n)
+}
+
+// isSlowError tells if the API could not serve the page in time
+func isSlowError(err error) bool {
+	switch e := err.(type) {
+	case *HTTPError:
+		return e.StatusCode >= 500
+	case net.Error:
+		return e.Timeout()
+	}
+	return false
+}
+
+// withLimit returns the job with another limit. The offset stays, and the
+// limit in the next_page link is changed too
+func (j job) withLimit(n int) job {
+	if n == j.limit {
+		return j
+	}
+	j.limit = n
+
+	if j.nextPage == "" {
+		return j
+	}
+	u, err := url.Parse(j.nextPage)
+	if err != nil {
+		logError(err)
+		j.nextPage = ""
+		return j
+	}
+	query := u.Query()
+	query.Set("limit", strconv.Itoa(n))
+	u.RawQuery = query.Encode()
+	j.nextPage = u.String()
+
+	return j
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+func TestPageSize(t *testing.T) {
+	p := pageSize{Min: 50, Max: 400}.withDefaults()
+
+	// fast and full pages grow up to max
+	assert.Equal(t, 200, p.afterPage(100, 100, time.Second))
+	assert.Equal(t, 400, p.afterPage(400, 400, time.Second))
+	// slow or last pages keep the size
+	assert.Equal(t, 100, p.afterPage(100, 100, 10*time.Second))
+	assert.Equal(t, 100, p.afterPage(100, 30, time.Second))
+
+	// timeouts and 5xx shrink down to min
+	assert.Equal(t, 50, p.afterError(100, &HTTPError{StatusCode: 502}))
+	assert.Equal(t, 50, p.afterError(50, &HTTPError{StatusCode: 500}))
+	assert.Equal(t, 100, p.afterError(200, &url.Error{Op: "Get", URL: "http://api", Err: timeoutError{}}))
+	assert.Equal(t, 200, p.afterError(200, &HTTPError{StatusCode: 404}))
+	assert.Equal(t, 200, p.afterError(200, errors.New("connection reset")))
+
+	// fixed by default
+	p = pageSize{}.withDefaults()
+	assert.Equal(t, limit, p.afterPage(limit, limit, time.Second))
+	assert.Equal(t, limit, p.afterError(limit, &HTTPError{StatusCode: 500}))
+}
+
+func TestJobWithLimit(t *testing.T) {
+	j := job{offset: 200, limit: 100, nextPage: "/conversion.json?offset=200&limit=100"}
+
+	n := j.withLimit(50)
+	assert.Equal(t, 200, n.offset)
+	assert.Equal(t, 50, n.limit)
+	assert.Equal(t, "/conversion.json?limit=50&offset=200", n.nextPage)
+
+	// the link of the next page is followed with the new limit
+	n = n.next(pagination{NextPage: "/conversion.json?offset=250&limit=50"}, 50).withLimit(100)
+	assert.Equal(t, 250, n.offset)
+	assert.Equal(t, 100, n.limit)
+	assert.Equal(t, "/conversion.json?limit=100&offset=250", n.nextPage)
+}
+
+func TestFetchPageShrink(t *testing.T) {
+	policy := retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	source := &failingSource{errs: []error{&HTTPError{StatusCode: 500}, &HTTPError{StatusCode: 504}}}
+	worker := fetchWorker{source: source, retry: policy, pageSize: pageSize{Min: 20, Max: 200}, currJob: job{limit: 100}}
+	_, err := worker.fetchPage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []int{100, 50, 25}, source.limits)
+	// the empty page does not grow it
+	assert.Equal(t, 25, worker.nextLimit)
+}
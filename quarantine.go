@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// quarantine is a conversion which can not be parsed, kept with its payload.
+// PublisherRef can be fixed by hand before running it again
+type quarantine struct {
+	ID             int       `orm:"column(id);pk;auto" json:"id"`
+	ConversionID   string    `orm:"column(conversion_id)" json:"conversion_id"`
+	ConversionTime string    `orm:"column(conversion_time)" json:"conversion_time"`
+	AccountID      int       `orm:"column(account_id)" json:"account_id"`
+	PublisherRef   string    `orm:"column(publisher_reference)" json:"publisher_reference"`
+	RawData        string    `orm:"column(raw_data)" json:"raw_data"`
+	CurrencyMode   string    `orm:"column(currency_mode)" json:"currency_mode"` // see restoreCurrency
+	Origin         string    `orm:"column(origin)" json:"origin"`
+	Error          string    `orm:"column(error)" json:"error"`
+	Resolved       int       `orm:"column(resolved)" json:"resolved"` // 0 pending, 1 saved
+	CreatedAt      time.Time `orm:"column(created_at);type(timestamp)" json:"created_at"`
+	UpdatedAt      time.Time `orm:"column(updated_at);type(timestamp)" json:"updated_at"`
+}
+
+func (q *quarantine) TableName() string {
+	return "affi_conversion_quarantine"
+}
+
+func newQuarantine(item *conversionItem, a *account, err error) *quarantine {
+	q := &quarantine{
+		ConversionID:   item.ConvData.ID,
+		ConversionTime: item.ConvData.ConversionTime,
+		PublisherRef:   item.ConvData.PublisherRef,
+		RawData:        string(item.raw),
+		CurrencyMode:   item.currency,
+		Origin:         item.originJSON(),
+		Error:          redactedError(err),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	if a != nil {
+		q.AccountID = a.ID
+	}
+	return q
+}
+
+// upsert keeps one pending row for each conversion. A publisher_reference
+// fixed by hand is not overwritten
+func (q *quarantine) upsert(ctx context.Context) error {
+	sql := `INSERT INTO %s (conversion_id, conversion_time, account_id, publisher_reference,
+    raw_data, currency_mode, origin, error, resolved, created_at, updated_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?)
+    ON DUPLICATE KEY UPDATE raw_data=VALUES(raw_data), currency_mode=VALUES(currency_mode),
+    origin=VALUES(origin), error=VALUES(error), resolved=0, updated_at=VALUES(updated_at)`
+	sql = fmt.Sprintf(sql, q.TableName())
+
+	_, err := dbExec(ctx, sql, q.ConversionID, q.ConversionTime, q.AccountID, q.PublisherRef,
+		q.RawData, q.CurrencyMode, q.Origin, q.Error, reportTimeStr(q.CreatedAt),
+		reportTimeStr(q.UpdatedAt))
+	return err
+}
+
+// update saves the error and resolved state of q
+func (q *quarantine) update(ctx context.Context) error {
+	q.UpdatedAt = time.Now()
+	sql := fmt.Sprintf(`UPDATE %s SET error=?, resolved=?, updated_at=? WHERE id=?`, q.TableName())
+	_, err := dbExec(ctx, sql, q.Error, q.Resolved, reportTimeStr(q.UpdatedAt), q.ID)
+	return err
+}
+
+// findQuarantines returns quarantined conversions, pending ones only if all is false
+func findQuarantines(all bool) ([]quarantine, error) {
+	var list []quarantine
+
+	qs := MysqlORM.QueryTable(new(quarantine))
+	if !all {
+		qs = qs.Filter("resolved", 0)
+	}
+	_, err := qs.OrderBy("id").All(&list)
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// setQuarantineRef fixes the publisher_reference of a quarantined conversion
+func setQuarantineRef(ctx context.Context, id int, publisherRef string) error {
+	q := quarantine{}
+	sql := fmt.Sprintf(`select id from %s where id = ?`, q.TableName())
+	err := dbQueryRow(ctx, sql, []interface{}{id}, &q.ID)
+	if err != nil {
+		return err
+	}
+
+	sql = fmt.Sprintf(`UPDATE %s SET publisher_reference=?, updated_at=? WHERE id=?`, q.TableName())
+	_, err = dbExec(ctx, sql, publisherRef, reportTimeStr(time.Now()), q.ID)
+	return err
+}
+
+// rerun parses the payload again with the publisher_reference of the row.
+// Payloads fetched in native currency are converted with rates
+func (q *quarantine) rerun(ctx context.Context, run string, rates exchangeRates) error {
+	var item conversionItem
+
+	err := json.Unmarshal([]byte(q.RawData), &item)
+	if err != nil {
+		return err
+	}
+	item.ConvData.PublisherRef = q.PublisherRef
+	item.currency = q.CurrencyMode
+
+	a, err := accountByID(q.AccountID)
+	if err != nil {
+		return err
+	}
+
+	c, err := item.restore(q.Origin, rates, a.Atoken)
+	if err != nil {
+		return err
+	}
+
+	err = c.save(ctx, run)
+	if err != nil {
+		return err
+	}
+
+	return item.ConvData.toDetail(c.ConversionTime).upsert(ctx)
+}
+
+// rerunQuarantines saves pending quarantined conversions which can be parsed now,
+// until ctx is done. It returns the number of saved ones
+func rerunQuarantines(ctx context.Context, rates exchangeRates) (int, error) {
+	var savedNum int
+
+	list, err := findQuarantines(false)
+	if err != nil {
+		return 0, err
+	}
+
+	run := newRunID("quarantine")
+	for i := range list {
+		q := &list[i]
+		if ctx.Err() != nil {
+			return savedNum, ctx.Err()
+		}
+
+		err = q.rerun(ctx, run, rates)
+		if err != nil {
+			logErrorf("quarantine id=%d %v", q.ID, err)
+			q.Error = redactedError(err)
+			err = q.update(ctx)
+		} else {
+			q.Resolved = 1
+			savedNum++
+			err = q.update(ctx)
+		}
+		if err != nil {
+			return savedNum, err
+		}
+	}
+
+	return savedNum, nil
+}
+
+func printQuarantines(list []quarantine) {
+	fmt.Printf("ID \t ConversionID \t Time \t PublisherRef \t Resolved \t Error \n")
+	for _, q := range list {
+		fmt.Printf("%d \t %s \t %s \t %s \t %d \t %s \n", q.ID, q.ConversionID, q.ConversionTime, q.PublisherRef, q.Resolved, q.Error)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewQuarantine(t *testing.T) {
+	body := `{"conversion_data":{"conversion_id":"1000l893029726009","conversion_time":"2017-02-13 00:12:05","publisher_reference":"uabc:com.example.game"}}`
+
+	var item conversionItem
+	err := json.Unmarshal([]byte(body), &item)
+	assert.NoError(t, err)
+
+	_, err = item.ConvData.toConversion("at")
+	assert.Error(t, err)
+
+	q := newQuarantine(&item, &account{ID: 2}, err)
+	assert.Equal(t, "1000l893029726009", q.ConversionID)
+	assert.Equal(t, "uabc:com.example.game", q.PublisherRef)
+	assert.Equal(t, 2, q.AccountID)
+	assert.Equal(t, body, q.RawData)
+	assert.Equal(t, err.Error(), q.Error)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+)
+
+var (
+	// refParser parses publisher_reference of all conversions
+	refParser publisherRefParser = defaultRefParser()
+)
+
+// refInfo is what a publisher_reference tells about a conversion
+type refInfo struct {
+	Rule  string
+	UID   int
+	AppID string
+	Type  byte // 0: SDK, 1: Web
+	InApp byte
+	// other named groups of the rule, like campaign or placement
+	Tags map[string]string
+}
+
+type publisherRefParser interface {
+	parse(publisherRef, advRef string) (*refInfo, error)
+}
+
+// refRule matches publisher_reference with named groups. uid is required,
+// app_id is optional, any other group becomes a tag
+type refRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Type    byte   `json:"type"`
+	// pattern of advertiser_reference of in-app purchases
+	InApp string `json:"in_app"`
+
+	re      *regexp.Regexp
+	inAppRe *regexp.Regexp
+}
+
+func (r *refRule) compile() error {
+	var err error
+
+	r.re, err = regexp.Compile(r.Pattern)
+	if err != nil {
+		return fmt.Errorf("rule %s: %v", r.Name, err)
+	}
+	if r.re.SubexpIndex("uid") < 0 {
+		return fmt.Errorf("rule %s: pattern has no uid group", r.Name)
+	}
+
+	if r.InApp != "" {
+		r.inAppRe, err = regexp.Compile(r.InApp)
+		if err != nil {
+			return fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// ruleParser tries its rules in order and takes the first match
+type ruleParser struct {
+	rules []*refRule
+}
+
+func newRuleParser(rules []*refRule) (*ruleParser, error) {
+	for _, r := range rules {
+		err := r.compile()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ruleParser{rules: rules}, nil
+}
+
+// defaultRefParser parses u<uid>:<appid> as SDK and <uid>:<appid> as Web
+func defaultRefParser() *ruleParser {
+	p, err := newRuleParser([]*refRule{
+		{Name: "sdk", Pattern: `^u(?P<uid>\d+):(?P<app_id>[^:]*)`, Type: 0, InApp: "In-App"},
+		{Name: "web", Pattern: `^(?P<uid>\d+):(?P<app_id>[^:]*)`, Type: 1, InApp: "In-App"},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// loadRefParser reads rules from a json file, like
+// [{"name": "sdk", "pattern": "^u(?P<uid>\\d+):(?P<app_id>[^:]*)", "type": 0, "in_app": "In-App"}]
+func loadRefParser(path string) (*ruleParser, error) {
+	var rules []*refRule
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &rules)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no rule in %s", path)
+	}
+
+	return newRuleParser(rules)
+}
+
+func (p *ruleParser) parse(publisherRef, advRef string) (*refInfo, error) {
+	for _, r := range p.rules {
+		match := r.re.FindStringSubmatch(publisherRef)
+		if match == nil {
+			continue
+		}
+
+		info := &refInfo{
+			Rule: r.Name,
+			Type: r.Type,
+			Tags: make(map[string]string),
+		}
+
+		for i, name := range r.re.SubexpNames() {
+			switch name {
+			case "":
+			case "uid":
+				uid, err := strconv.Atoi(match[i])
+				if err != nil {
+					return nil, fmt.Errorf("convert uid %s of %s to int failed", match[i], publisherRef)
+				}
+				info.UID = uid
+			case "app_id":
+				info.AppID = match[i]
+			default:
+				info.Tags[name] = match[i]
+			}
+		}
+
+		if r.inAppRe != nil && r.inAppRe.MatchString(advRef) {
+			info.InApp = 1
+		}
+
+		return info, nil
+	}
+
+	return nil, fmt.Errorf("publisher_reference %q matches no rule", publisherRef)
+}
+
+// tagsString is the json of tags, empty if there is no tag
+func (info *refInfo) tagsString() string {
+	if len(info.Tags) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(info.Tags)
+	return string(b)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultRefParser(t *testing.T) {
+	p := defaultRefParser()
+
+	info, err := p.parse("u1024:com.example.game", "In-App Purchase")
+	assert.NoError(t, err)
+	assert.Equal(t, "sdk", info.Rule)
+	assert.Equal(t, 1024, info.UID)
+	assert.Equal(t, "com.example.game", info.AppID)
+	assert.Equal(t, byte(0), info.Type)
+	assert.Equal(t, byte(1), info.InApp)
+	assert.Equal(t, "", info.tagsString())
+
+	info, err = p.parse("1024:com.example.game:extra", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "web", info.Rule)
+	assert.Equal(t, 1024, info.UID)
+	assert.Equal(t, "com.example.game", info.AppID)
+	assert.Equal(t, byte(1), info.Type)
+	assert.Equal(t, byte(0), info.InApp)
+
+	_, err = p.parse("uabc:com.example.game", "")
+	assert.Error(t, err)
+
+	_, err = p.parse("", "")
+	assert.Error(t, err)
+}
+
+func TestLoadRefParser(t *testing.T) {
+	rules := `[
+  {"name": "sdk_v2", "pattern": "^u(?P<uid>\\d+):(?P<app_id>[^:]*):(?P<campaign>[^:]*)$", "type": 0, "in_app": "In-App"},
+  {"name": "sdk", "pattern": "^u(?P<uid>\\d+):(?P<app_id>[^:]*)", "type": 0}
+]`
+	f, err := ioutil.TempFile("", "refrules")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(rules)
+	f.Close()
+
+	p, err := loadRefParser(f.Name())
+	assert.NoError(t, err)
+
+	info, err := p.parse("u7:com.example.game:spring", "In-App")
+	assert.NoError(t, err)
+	assert.Equal(t, "sdk_v2", info.Rule)
+	assert.Equal(t, 7, info.UID)
+	assert.Equal(t, byte(1), info.InApp)
+	assert.Equal(t, `{"campaign":"spring"}`, info.tagsString())
+
+	info, err = p.parse("u7:com.example.game", "In-App")
+	assert.NoError(t, err)
+	assert.Equal(t, "sdk", info.Rule)
+	assert.Equal(t, byte(0), info.InApp)
+
+	_, err = newRuleParser([]*refRule{{Name: "bad", Pattern: `^(?P<id>\d+)`}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const (
+	reprocessBatch = 1000
+)
+
+// reprocessRaw rebuilds the conversions in [from, to) from affi_conversion_raw
+// without calling the API, until ctx is done. Payloads fetched in native
+// currency are converted with rates. It returns the number of read and saved
+// conversions, and of those which could not be saved with their detail
+func reprocessRaw(ctx context.Context, from, to time.Time, rates exchangeRates) (int, int, int, error) {
+	var lastID, readNum, savedNum, failedNum int
+	run := newRunID("reprocess")
+
+	for {
+		list, err := findRawByTime(ctx, from, to, lastID, reprocessBatch)
+		if err != nil {
+			return readNum, savedNum, failedNum, err
+		}
+		if len(list) == 0 {
+			break
+		}
+
+		for _, raw := range list {
+			if ctx.Err() != nil {
+				return readNum, savedNum, failedNum, ctx.Err()
+			}
+			lastID = raw.ID
+			readNum++
+
+			var item conversionItem
+			err = json.Unmarshal([]byte(raw.RawData), &item)
+			if err != nil {
+				logErrorf("raw id=%d %v", raw.ID, err)
+				failedNum++
+				continue
+			}
+			item.currency = raw.CurrencyMode
+
+			c, err := item.restore(raw.Origin, rates, raw.Atoken)
+			if err != nil {
+				logErrorf("raw id=%d %v", raw.ID, err)
+				err = newQuarantine(&item, accountByAtoken(raw.Atoken), err).upsert(ctx)
+				if err != nil {
+					logErrorf("raw id=%d %v", raw.ID, err)
+				}
+				failedNum++
+				continue
+			}
+
+			saved, err := c.rebuild(ctx, run)
+			if err != nil {
+				logErrorf("raw id=%d %v", raw.ID, err)
+				failedNum++
+				continue
+			}
+			err = item.ConvData.toDetail(c.ConversionTime).upsert(ctx)
+			if err != nil {
+				logErrorf("raw id=%d detail %v", raw.ID, err)
+				failedNum++
+				continue
+			}
+			if saved {
+				savedNum++
+			}
+		}
+	}
+
+	return readNum, savedNum, failedNum, nil
+}
+
+// restore parses a stored payload into a conversion, in the currency it was
+// saved in
+func (c *conversionItem) restore(origin string, rates exchangeRates, at string) (*conversion, error) {
+	err := restoreCurrency(&c.ConvData, c.currency, origin, rates)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ConvData.toConversion(at)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	// temporary errors, retried with backoff
+	errClassRetry = iota
+	// bad json, retried once
+	errClassDecode
+	// other 4xx, the page can not be fetched
+	errClassFatal
+	// 401 and 403, the whole job is aborted
+	errClassAuth
+)
+
+var errClassNames = map[int]string{
+	errClassRetry:  "retry",
+	errClassDecode: "decode",
+	errClassFatal:  "fatal",
+	errClassAuth:   "auth",
+}
+
+// retryPolicy decides how a failed page is retried
+type retryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func (p retryPolicy) withDefaults() retryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 5
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = time.Second
+	}
+	if p.MaxDelay < p.BaseDelay {
+		p.MaxDelay = 60 * time.Second
+	}
+	return p
+}
+
+// delay is the exponential backoff before the next attempt, with jitter.
+// attempt starts from 1
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	// keep half of it and randomize the other half
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// sleepContext sleeps for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pageError is returned when a page can not be fetched after retries
+type pageError struct {
+	err      error
+	class    int
+	attempts int
+}
+
+func (e *pageError) Error() string {
+	return fmt.Sprintf("%s error after %d attempts: %v", errClassNames[e.class], e.attempts, e.err)
+}
+
+// saveError is returned when a page is fetched but some of its conversions
+// can not be saved, the page is dead-lettered like a failed one
+type saveError struct {
+	failed int
+	items  int
+}
+
+func (e *saveError) Error() string {
+	return fmt.Sprintf("%d saves failed for %d conversions", e.failed, e.items)
+}
+
+func classifyError(err error) int {
+	switch e := err.(type) {
+	case *HTTPError:
+		switch {
+		case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+			return errClassAuth
+		case e.StatusCode == http.StatusTooManyRequests:
+			return errClassRetry
+		case e.StatusCode >= 400 && e.StatusCode < 500:
+			return errClassFatal
+		}
+	case *json.SyntaxError, *json.UnmarshalTypeError, *streamError:
+		return errClassDecode
+	case *cassetteMissError:
+		// replaying again does not help
+		return errClassFatal
+	}
+
+	// 5xx, timeouts and connection errors
+	return errClassRetry
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	var v struct{}
+	decodeErr := json.Unmarshal([]byte("{bad"), &v)
+
+	assert.Equal(t, errClassAuth, classifyError(&HTTPError{StatusCode: 401}))
+	assert.Equal(t, errClassAuth, classifyError(&HTTPError{StatusCode: 403}))
+	assert.Equal(t, errClassFatal, classifyError(&HTTPError{StatusCode: 404}))
+	assert.Equal(t, errClassRetry, classifyError(&HTTPError{StatusCode: 429}))
+	assert.Equal(t, errClassRetry, classifyError(&HTTPError{StatusCode: 502}))
+	assert.Equal(t, errClassDecode, classifyError(decodeErr))
+	assert.Equal(t, errClassRetry, classifyError(errors.New("i/o timeout")))
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := retryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}.withDefaults()
+
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		d := p.delay(attempt + 1)
+		assert.True(t, d >= max/2 && d <= max, "attempt %d delay %s", attempt+1, d)
+	}
+}
+
+func TestRetryOfRun(t *testing.T) {
+	sch := newScheduler(1, &failingSource{}, nil)
+	sch.retry = retryPolicy{MaxAttempts: 3}
+	w := newFetchWorker(job{}, sch)
+	assert.Equal(t, 3, w.retry.MaxAttempts)
+
+	// a run with its own policy does not change the others
+	sch.assign(w, job{retry: retryPolicy{MaxAttempts: 7}})
+	assert.Equal(t, 7, w.retry.MaxAttempts)
+	sch.assign(w, job{})
+	assert.Equal(t, 3, w.retry.MaxAttempts)
+}
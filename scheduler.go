@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gizak/termui"
-	"github.com/golang/glog"
 )
 
 const (
@@ -18,102 +20,486 @@ type job struct {
 	to     time.Time
 	offset int
 	limit  int
+	// next_page link returned by the API for this page
+	nextPage string
+	account  *account
+	// run which the job belongs to
+	run string
+	// id in affi_fetch_checkpoint, 0 if the job is not saved
+	checkpoint int
+	// conversion time of the last saved item when the job is resumed
+	lastConvTime time.Time
+	// retry policy of the run, the one of the scheduler if it is zero
+	retry retryPolicy
 }
 
 func (j job) String() string {
-	return fmt.Sprintf("-from=%s -to=%s -offset=%d", j.from.Format("2006-01-02T15:04:05"), j.to.Format("2006-01-02T15:04:05"), j.offset)
+	if j.account != nil {
+		return fmt.Sprintf("-account=%s -from=%s -to=%s -offset=%d", j.account.Name, reportTimeStr(j.from), reportTimeStr(j.to), j.offset)
+	}
+	return fmt.Sprintf("-from=%s -to=%s -offset=%d", reportTimeStr(j.from), reportTimeStr(j.to), j.offset)
+}
+
+// savedUntil is the conversion time of the last saved item of j, from if
+// nothing is saved yet
+func (j job) savedUntil() time.Time {
+	if j.lastConvTime.IsZero() {
+		return j.from
+	}
+	return j.lastConvTime
+}
+
+// next returns the job of the following page. It follows the next_page link of
+// the API if there is one, and otherwise moves the offset by the number of
+// items the page had, which can be fewer than its limit
+func (j job) next(p pagination, items int) job {
+	n := j
+	n.nextPage = p.NextPage
+	n.offset += items
+
+	if p.NextPage == "" {
+		return n
+	}
+
+	u, err := url.Parse(p.NextPage)
+	if err != nil {
+		logError(err)
+		n.nextPage = ""
+		return n
+	}
+
+	query := u.Query()
+	if offset, err := strconv.Atoi(query.Get("offset")); err == nil {
+		n.offset = offset
+	}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 {
+		n.limit = limit
+	}
+
+	return n
 }
 
 type scheduler struct {
 	workerID int
 	workers  []*fetchWorker
 	mutex    sync.Mutex
+	source   ConversionSource
+	// limiter is shared by all workers
+	limiter *rateLimiter
+	// retry policy of current run
+	retry retryPolicy
+	// bounds of the page size of jobs
+	pageSize pageSize
+	// failed page number of current run by account ID
+	failedPages map[int]int
+	// slices waiting for an idle worker
+	queue workQueue
+	// save the progress of jobs to affi_fetch_checkpoint
+	checkpoints bool
+	// dead letters are being replayed beside the workers
+	replaying bool
+	// the terminal UI is drawn, the terminal must be restored before exit
+	uiRunning bool
+	// canceled on shutdown, the context of each job is derived from it
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func newScheduler(num int) *scheduler {
+func newScheduler(num int, source ConversionSource, limiter *rateLimiter) *scheduler {
 	sch := &scheduler{
-		workers: make([]*fetchWorker, 0, num),
-		mutex:   sync.Mutex{},
+		workers:     make([]*fetchWorker, 0, num),
+		mutex:       sync.Mutex{},
+		source:      source,
+		limiter:     limiter,
+		failedPages: make(map[int]int),
 	}
+	sch.ctx, sch.cancel = context.WithCancel(context.Background())
 
 	return sch
 }
 
 func (sch *scheduler) createWorker(workerNum int) {
+	sch.mutex.Lock()
+	defer sch.mutex.Unlock()
+
 	for i := 0; i < workerNum; i++ {
-		w := newFetchWorker(job{}, sch)
-		sch.appendWorker(w)
+		sch.workers = append(sch.workers, newFetchWorker(job{}, sch))
 	}
 }
 
+// receiveJobs queues jobs as one run and starts the idle workers. There may
+// be any number of jobs, workers pull the next one when they are done
 func (sch *scheduler) receiveJobs(jobs []job) {
-	if len(jobs) > len(sch.workers) {
-		glog.Error("jobs.length is larger sch.workers")
-		return
+	run := newRunID("fetch")
+	for i := range jobs {
+		jobs[i].run = run
+	}
+
+	sch.queueJobs(jobs)
+}
+
+// queueJobs saves a checkpoint of the new jobs, queues them and starts the
+// idle workers
+func (sch *scheduler) queueJobs(jobs []job) {
+	sch.saveCheckpoints(jobs)
+
+	sch.mutex.Lock()
+	defer sch.mutex.Unlock()
+
+	sch.queue.push(jobs...)
+	sch.startIdle()
+}
+
+// startIdle gives the queued jobs to the workers which are not running.
+// The mutex must be held
+func (sch *scheduler) startIdle() {
+	for _, w := range sch.workers {
+		if w.status == statusRunning {
+			continue
+		}
+		j, ok := sch.queue.pop()
+		if !ok {
+			return
+		}
+		sch.assign(w, j)
+		go w.Run()
+	}
+}
+
+// nextJob gives w the next queued job. If there is none, or the scheduler is
+// shut down, w stops with status and err and false is returned. A retired
+// worker leaves the pool instead
+func (sch *scheduler) nextJob(w *fetchWorker, status int, err error) bool {
+	sch.mutex.Lock()
+	defer sch.mutex.Unlock()
+
+	if w.retired {
+		sch.removeWorker(w)
+	} else if sch.ctx.Err() == nil {
+		if j, ok := sch.queue.pop(); ok {
+			sch.assign(w, j)
+			return true
+		}
+	}
+
+	w.mutex.Lock()
+	w.status = status
+	w.lastErr = err
+	w.mutex.Unlock()
+	return false
+}
+
+// splitJob queues j again in two halves when its first page says it is too
+// long for one worker, see shouldSplit. The items of the first page are saved
+// again by the first half. The halves are checkpointed before j is done, so a
+// crash in between fetches too much rather than too little
+func (sch *scheduler) splitJob(j job, p pagination) bool {
+	if !shouldSplit(j, p) {
+		return false
 	}
 
-	for i := 0; i < len(sch.workers); i++ {
-		sch.workers[i].currJob = jobs[i]
+	jobs, err := seperateJobs(j.from, j.to, 2)
+	if err != nil {
+		logError(err)
+		return false
+	}
+	for i := range jobs {
+		jobs[i].account = j.account
+		jobs[i].run = j.run
+		jobs[i].retry = j.retry
 	}
+	sch.saveCheckpoints(jobs)
+	sch.jobDone(sch.ctx, j)
+
+	sch.mutex.Lock()
+	defer sch.mutex.Unlock()
+
+	sch.queue.pushFront(jobs...)
+	sch.startIdle()
+	return true
+}
+
+// releaseJob queues j, the rest of the job of w, for another worker if w is
+// retired. It returns false if w should go on with j
+func (sch *scheduler) releaseJob(w *fetchWorker, j job) bool {
+	sch.mutex.Lock()
+	defer sch.mutex.Unlock()
 
-	for _, worker := range sch.workers {
-		go worker.Run()
+	if !w.retired {
+		return false
 	}
+	sch.queue.pushFront(j)
+	sch.startIdle()
+	return true
 }
 
-func (sch *scheduler) appendWorker(w *fetchWorker) {
+// resize grows or shrinks the pool to num workers. New workers start on the
+// queued jobs at once. Idle workers leave at once, running ones after their
+// current page, handing the rest of their job back to the queue
+func (sch *scheduler) resize(num int) error {
+	if num < 1 {
+		return fmt.Errorf("at least one worker is needed, not %d", num)
+	}
+
 	sch.mutex.Lock()
-	sch.workers = append(sch.workers, w)
+	defer sch.mutex.Unlock()
+
+	size := sch.sizeLocked()
+	// bring back retired workers which are still on their page first
+	for _, w := range sch.workers {
+		if size < num && w.retired {
+			w.retired = false
+			size++
+		}
+	}
+	for ; size < num; size++ {
+		sch.workers = append(sch.workers, newFetchWorker(job{}, sch))
+	}
+
+	// idle workers leave first
+	for i := len(sch.workers) - 1; i >= 0 && size > num; i-- {
+		if w := sch.workers[i]; w.status != statusRunning {
+			sch.removeWorker(w)
+			size--
+		}
+	}
+	for i := len(sch.workers) - 1; i >= 0 && size > num; i-- {
+		if w := sch.workers[i]; !w.retired {
+			w.retired = true
+			size--
+		}
+	}
+
+	sch.startIdle()
+	return nil
+}
+
+// size is the number of workers which are not retired
+func (sch *scheduler) size() int {
+	sch.mutex.Lock()
+	defer sch.mutex.Unlock()
+	return sch.sizeLocked()
+}
+
+func (sch *scheduler) sizeLocked() int {
+	var num int
+	for _, w := range sch.workers {
+		if !w.retired {
+			num++
+		}
+	}
+	return num
+}
+
+// removeWorker drops w from the pool. The mutex must be held
+func (sch *scheduler) removeWorker(w *fetchWorker) {
+	if w.cancel != nil {
+		w.cancel()
+	}
+
+	for i := range sch.workers {
+		if sch.workers[i] == w {
+			sch.workers = append(sch.workers[:i:i], sch.workers[i+1:]...)
+			return
+		}
+	}
+}
+
+// queued is the number of jobs waiting for a worker
+// busy tells if a worker is running, a job is queued or dead letters are
+// being replayed
+func (sch *scheduler) busy() bool {
+	sch.mutex.Lock()
+	defer sch.mutex.Unlock()
+	return sch.busyLocked()
+}
+
+// busyLocked is busy with the mutex held
+func (sch *scheduler) busyLocked() bool {
+	if sch.replaying || sch.queue.len() > 0 {
+		return true
+	}
+	for _, w := range sch.workers {
+		if w.status == statusRunning {
+			return true
+		}
+	}
+	return false
+}
+
+// startReplay marks dead letters as being replayed, it returns false if the
+// scheduler is busy. endReplay must be called when the replay is over
+func (sch *scheduler) startReplay() bool {
+	sch.mutex.Lock()
+	defer sch.mutex.Unlock()
+
+	if sch.busyLocked() {
+		return false
+	}
+	sch.replaying = true
+	return true
+}
+
+func (sch *scheduler) endReplay() {
+	sch.mutex.Lock()
+	sch.replaying = false
 	sch.mutex.Unlock()
 }
 
-func (sch *scheduler) rescheduleJob() error {
-	var stoppedWorker, runningWorker *fetchWorker
+func (sch *scheduler) queued() int {
+	sch.mutex.Lock()
+	defer sch.mutex.Unlock()
+	return sch.queue.len()
+}
 
+// assign gives j to w with a new cancelable context. The mutex must be held,
+// and w must be idle or be the caller
+func (sch *scheduler) assign(w *fetchWorker, j job) {
+	if w.cancel != nil {
+		// release the context of the last job
+		w.cancel()
+	}
+	w.ctx, w.cancel = context.WithCancel(sch.ctx)
+
+	w.mutex.Lock()
+	w.currJob = j
+	w.status = statusRunning
+	w.lastErr = nil
+	w.totalItemNum = 0
+	w.mutex.Unlock()
+
+	w.lastConvTime = j.savedUntil()
+	w.lastPage = pagination{}
+	w.retry = sch.retryOf(j)
+	w.pageSize = sch.pageSize
+}
+
+// retryOf is the retry policy j is fetched with
+func (sch *scheduler) retryOf(j job) retryPolicy {
+	if j.retry.MaxAttempts > 0 {
+		return j.retry
+	}
+	return sch.retry
+}
+
+// cancelJob aborts the job of worker id, with its in-flight request and
+// queries. The worker goes on with the next queued job. It returns false if
+// the worker is not running
+func (sch *scheduler) cancelJob(id int) bool {
 	sch.mutex.Lock()
 	defer sch.mutex.Unlock()
 
 	for _, w := range sch.workers {
-		if w.status == statusStop {
-			stoppedWorker = w
+		if w.id == id && w.status == statusRunning && w.cancel != nil && w.ctx.Err() == nil {
+			w.cancel()
+			return true
 		}
+	}
+	return false
+}
+
+// cancelJobs aborts the jobs of all workers and drops the queued ones, which
+// count as failed pages. New jobs can still be received. It returns the
+// number of canceled and dropped jobs
+func (sch *scheduler) cancelJobs() int {
+	var num int
 
-		if runningWorker == nil && longerThan(w.lastConvTime, w.currJob.to, time.Hour) && (w.status == statusRunning) {
-			runningWorker = w
+	sch.mutex.Lock()
+	dropped := sch.queue.clear()
+	for _, w := range sch.workers {
+		if w.status == statusRunning && w.cancel != nil && w.ctx.Err() == nil {
+			w.cancel()
+			num++
 		}
 	}
+	sch.mutex.Unlock()
 
-	if runningWorker != nil && stoppedWorker != nil {
-		jobs, err := seperateJobs(runningWorker.lastConvTime, runningWorker.currJob.to, 2)
-		if err != nil {
-			return err
+	for _, j := range dropped {
+		sch.pageFailed(j)
+	}
+	return num + len(dropped)
+}
+
+// shutdown aborts all jobs, and any job received later at once
+func (sch *scheduler) shutdown() {
+	sch.cancel()
+}
+
+// pageFailed counts a page which could not be fetched or saved
+func (sch *scheduler) pageFailed(j job) {
+	if sch == nil || j.account == nil {
+		return
+	}
+
+	sch.mutex.Lock()
+	sch.failedPages[j.account.ID]++
+	sch.mutex.Unlock()
+}
+
+func (sch *scheduler) failures(accountID int) int {
+	sch.mutex.Lock()
+	defer sch.mutex.Unlock()
+	return sch.failedPages[accountID]
+}
+
+func (sch *scheduler) resetFailures() {
+	sch.mutex.Lock()
+	sch.failedPages = make(map[int]int)
+	sch.mutex.Unlock()
+}
+
+// wait blocks until no worker is running
+func (sch *scheduler) wait() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		running := false
+		for _, s := range sch.snapshot() {
+			if s.Status == statusRunning {
+				running = true
+			}
 		}
-		if len(jobs) == 2 {
-			stoppedWorker.currJob = jobs[0]
-			runningWorker.currJob = jobs[1]
-			go stoppedWorker.Run()
-		} else {
-			return fmt.Errorf("jobs length is not 2; %#v", jobs)
+
+		if !running {
+			return
 		}
 	}
+}
 
-	return nil
+// snapshot is the state of all workers
+func (sch *scheduler) snapshot() []workerSnapshot {
+	sch.mutex.Lock()
+	workers := append([]*fetchWorker(nil), sch.workers...)
+	sch.mutex.Unlock()
+
+	list := make([]workerSnapshot, 0, len(workers))
+	for _, w := range workers {
+		list = append(list, w.snapshot())
+	}
+	return list
 }
 
 func (sch *scheduler) totalProcess(info *fetchInfo) {
-	var offset, fetched, saved, stopWorkerNum, workerNum int
-	for _, w := range sch.workers {
+	var offset, fetched, saved, total, stopWorkerNum, workerNum int
+	for _, s := range sch.snapshot() {
 		workerNum++
-		offset += w.currJob.offset
-		fetched += w.fetechedItemNum
-		saved += w.savedItemNum
-		stopWorkerNum += w.status
+		offset += s.Job.offset
+		fetched += s.Fetched
+		saved += s.Saved
+		total += s.Total
+		if s.Status != statusRunning {
+			stopWorkerNum++
+		}
 	}
 	info.Offset = offset
 	info.FetchedNum = fetched
 	info.SavedNum = saved
+	info.TotalNum = total
+	info.Limiter = sch.limiter.state()
 	info.StopNum = stopWorkerNum
 	info.WorkerNum = workerNum
+	info.Queued = sch.queued()
 }
 
 func (sch *scheduler) printProcess() {
@@ -126,11 +512,13 @@ func (sch *scheduler) printProcess() {
 	for range ticker.C {
 		updateStdout()
 		printHeader()
-		for _, w := range sch.workers {
-			printWorker(w)
+		for _, s := range sch.snapshot() {
+			printWorker(s)
 			allStop = true
-			allStop = allStop && (w.status == statusStop)
+			allStop = allStop && (s.Status == statusStop)
 		}
+		fmt.Printf("queued: %d \n", sch.queued())
+		fmt.Println(sch.limiter.state())
 		fmt.Println(time.Now().Sub(start))
 
 		if allStop {
@@ -138,9 +526,9 @@ func (sch *scheduler) printProcess() {
 		}
 	}
 
-	for _, w := range sch.workers {
-		totalItemNum += w.fetechedItemNum
-		totalSavedItemNum += w.savedItemNum
+	for _, s := range sch.snapshot() {
+		totalItemNum += s.Fetched
+		totalSavedItemNum += s.Saved
 	}
 
 	fmt.Printf("total: %d , total save: %d \n", totalItemNum, totalSavedItemNum)
@@ -157,38 +545,56 @@ func (sch *scheduler) printProcessWithUI() {
 	if err != nil {
 		panic(err)
 	}
-	defer termui.Close()
+	sch.mutex.Lock()
+	sch.uiRunning = true
+	sch.mutex.Unlock()
+	defer sch.closeUI()
 
 	// top bar
-	header := termui.NewPar("Press q to quit")
+	header := termui.NewPar("Press q to quit, + or - to add or remove a worker")
 	header.Height = 1
-	header.Width = 50
+	header.Width = 100
 	header.Border = false
 	header.TextBgColor = termui.ColorBlue
 	termui.Render(header)
 
 	//fmt.Printf("ID \t Status \t Offset \t Item \t SavedItem \t Range \n")
-	tableHeader := []string{"ID", "Status", "Offset", "Item", "SavedItem", "Range"}
+	tableHeader := []string{"ID", "Status", "Offset", "Limit", "Item", "SavedItem", "Total", "Range"}
 	table1 := termui.NewTable()
 	table1.FgColor = termui.ColorWhite
 	table1.BgColor = termui.ColorDefault
 	table1.Y = 1
 	table1.X = 0
 
-	// press q to quit
+	// press q to cancel all jobs and quit
 	termui.Handle("/sys/kbd/q", func(termui.Event) {
+		sch.cancelJobs()
 		termui.StopLoop()
 	})
 
+	termui.Handle("/sys/kbd/+", func(termui.Event) {
+		sch.resize(sch.size() + 1)
+	})
+	termui.Handle("/sys/kbd/-", func(termui.Event) {
+		err := sch.resize(sch.size() - 1)
+		if err != nil {
+			logError(err)
+		}
+	})
+
 	termui.Handle("/timer/1s", func(e termui.Event) {
 		rows := make([][]string, 0, 10)
 		rows = append(rows, tableHeader)
-		for _, w := range sch.workers {
-			rows = append(rows, w.getStatus())
+		for _, s := range sch.snapshot() {
+			rows = append(rows, s.row())
 			allStop = true
-			allStop = allStop && (w.status == statusStop)
+			allStop = allStop && (s.Status == statusStop)
 		}
 
+		header.Text = fmt.Sprintf("Press q to quit, + or - to add or remove a worker | workers: %d | queued: %d | %s",
+			sch.size(), sch.queued(), sch.limiter.state())
+		termui.Render(header)
+
 		table1.Rows = rows
 		table1.Analysis()
 		table1.SetSize()
@@ -205,20 +611,32 @@ func (sch *scheduler) printProcessWithUI() {
 
 	termui.Loop()
 
-	for _, w := range sch.workers {
-		totalItemNum += w.fetechedItemNum
-		totalSavedItemNum += w.savedItemNum
+	for _, s := range sch.snapshot() {
+		totalItemNum += s.Fetched
+		totalSavedItemNum += s.Saved
 	}
 
 	fmt.Printf("total: %d , total save: %d \n", totalItemNum, totalSavedItemNum)
 }
 
+// closeUI restores the terminal if the terminal UI is drawn
+func (sch *scheduler) closeUI() {
+	sch.mutex.Lock()
+	running := sch.uiRunning
+	sch.uiRunning = false
+	sch.mutex.Unlock()
+
+	if running {
+		termui.Close()
+	}
+}
+
 func printHeader() {
-	fmt.Printf("ID \t Status \t Offset \t Item \t SavedItem \t Range \n")
+	fmt.Printf("ID \t Status \t Offset \t Limit \t Item \t SavedItem \t Total \t Range \n")
 }
 
-func printWorker(w *fetchWorker) {
-	fmt.Printf("%d \t %s \t %d \t %d \t %d \t %s \n", w.id, w.statusName(), w.currJob.offset, w.fetechedItemNum, w.savedItemNum, w.currJob.String())
+func printWorker(s workerSnapshot) {
+	fmt.Printf("%d \t %s \t %d \t %d \t %d \t %d \t %d \t %s \n", s.ID, s.statusName(), s.Job.offset, s.Job.limit, s.Fetched, s.Saved, s.Total, s.Job.String())
 }
 
 func seperateJobs(fromTime, toTime time.Time, jobNum int) ([]job, error) {
@@ -245,12 +663,14 @@ func seperateJobs(fromTime, toTime time.Time, jobNum int) ([]job, error) {
 	return result, nil
 }
 
+// strToTime parses a time of the command line in the report timezone
 func strToTime(timeStr string) (time.Time, error) {
-	return time.Parse("2006-01-02T15:04:05", timeStr)
+	return time.ParseInLocation(reportTimeFormat, timeStr, reportLoc)
 }
 
+// strToTimeNoT parses a time of the web API in the report timezone
 func strToTimeNoT(timeStr string) (time.Time, error) {
-	return time.Parse("2006-01-02 15:04:05", timeStr)
+	return time.ParseInLocation(sourceTimeFormat, timeStr, reportLoc)
 }
 
 func gotoxy(x, y int) {
@@ -262,7 +682,3 @@ func updateStdout() {
 	//\033[H\033[J
 	fmt.Printf("\033[H\033[J")
 }
-
-func longerThan(from, to time.Time, d time.Duration) bool {
-	return to.Sub(from) > d
-}
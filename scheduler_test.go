@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,3 +28,166 @@ func TestJobs(t *testing.T) {
 		fmt.Printf("%s - %s \n", from, to)
 	}
 }
+
+func TestNextJob(t *testing.T) {
+	fromTime, _ := strToTimeNoT("2017-02-13 00:00:00")
+	toTime, _ := strToTimeNoT("2017-02-13 23:59:59")
+	j := job{from: fromTime, to: toTime, offset: 0, limit: 100}
+
+	// follow the link, including a changed page size
+	p := pagination{NextPage: "/reporting/report_publisher/publisher/1010l19090/conversion.json?offset=50&limit=50"}
+	n := j.next(p, 50)
+	assert.Equal(t, 50, n.offset)
+	assert.Equal(t, 50, n.limit)
+	assert.Equal(t, p.NextPage, n.nextPage)
+
+	// no link, move by the items of the page even if the API returned fewer
+	// than the limit
+	n = n.next(pagination{}, 50)
+	assert.Equal(t, 100, n.offset)
+	assert.Equal(t, "", n.nextPage)
+	n = n.next(pagination{}, 30)
+	assert.Equal(t, 130, n.offset)
+	assert.Equal(t, 50, n.limit)
+}
+
+func TestPageFailures(t *testing.T) {
+	sch := newScheduler(1, nil, nil)
+	a := &account{ID: 3, Name: "cn"}
+
+	sch.pageFailed(job{account: a})
+	sch.pageFailed(job{account: a})
+	assert.Equal(t, 2, sch.failures(3))
+	assert.Equal(t, 0, sch.failures(4))
+
+	sch.resetFailures()
+	assert.Equal(t, 0, sch.failures(3))
+}
+
+// blockingSource serves no page until the job is canceled
+type blockingSource struct {
+	started chan struct{}
+}
+
+func (s *blockingSource) FetchPage(ctx context.Context, j job, fn itemHandler) (*conversionList, error) {
+	s.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCancelJob(t *testing.T) {
+	source := &blockingSource{started: make(chan struct{}, 2)}
+	sch := newScheduler(2, source, nil)
+	sch.createWorker(2)
+	a := &account{ID: 3, Name: "cn"}
+
+	sch.receiveJobs([]job{{account: a, limit: 10}, {account: a, limit: 10}})
+	<-source.started
+	<-source.started
+
+	assert.True(t, sch.cancelJob(sch.workers[0].id))
+	assert.Equal(t, 1, sch.cancelJobs())
+	sch.wait()
+
+	for _, s := range sch.snapshot() {
+		assert.Equal(t, statusCanceled, s.Status)
+		assert.Equal(t, context.Canceled, s.Err)
+	}
+	// canceled pages hold the watermark
+	assert.Equal(t, 2, sch.failures(3))
+	assert.False(t, sch.cancelJob(sch.workers[0].id))
+
+	// no job runs after shutdown
+	sch.shutdown()
+	sch.receiveJobs([]job{{account: a, limit: 10}})
+	sch.wait()
+	assert.Equal(t, statusCanceled, sch.snapshot()[0].Status)
+}
+
+// gateSource serves pages of 100 empty items up to offset 300 once gate is closed
+type gateSource struct {
+	started chan struct{}
+	gate    chan struct{}
+	mutex   sync.Mutex
+	pages   map[string]int
+}
+
+func (s *gateSource) FetchPage(ctx context.Context, j job, fn itemHandler) (*conversionList, error) {
+	var list conversionList
+
+	s.started <- struct{}{}
+	<-s.gate
+
+	s.mutex.Lock()
+	s.pages[fmt.Sprintf("%d-%d", j.from.Unix(), j.offset)]++
+	s.mutex.Unlock()
+
+	if j.offset < 300 {
+		list.Hypermedia.Pagination.NextPage = fmt.Sprintf("/conversion.json?offset=%d&limit=100", j.offset+100)
+	}
+	return &list, nil
+}
+
+func TestResize(t *testing.T) {
+	from := time.Date(2017, 2, 13, 0, 0, 0, 0, time.UTC)
+	a := &account{ID: 3, Name: "cn"}
+	source := &gateSource{started: make(chan struct{}, 100), gate: make(chan struct{}), pages: make(map[string]int)}
+	sch := newScheduler(2, source, nil)
+	sch.createWorker(2)
+
+	// idle workers come and go at once
+	assert.Error(t, sch.resize(0))
+	assert.NoError(t, sch.resize(3))
+	assert.Equal(t, 3, len(sch.snapshot()))
+	assert.NoError(t, sch.resize(2))
+	assert.Equal(t, 2, len(sch.snapshot()))
+
+	jobs, err := sliceAccountJobs([]*account{a}, from, from.Add(2*time.Hour), time.Hour)
+	assert.NoError(t, err)
+	sch.receiveJobs(jobs)
+	<-source.started
+	<-source.started
+
+	// a running worker finishes its page, another one goes on with its job
+	assert.NoError(t, sch.resize(1))
+	assert.Equal(t, 1, sch.size())
+	close(source.gate)
+	sch.wait()
+
+	assert.Equal(t, 1, len(sch.snapshot()))
+	assert.Len(t, source.pages, 8)
+	for page, num := range source.pages {
+		assert.Equal(t, 1, num, page)
+	}
+}
+
+func TestPageItems(t *testing.T) {
+	w := fetchWorker{currJob: job{limit: 100}, page: pageCount{items: 30}}
+
+	assert.Equal(t, 30, w.pageItems(nil))
+	assert.Equal(t, 30, w.pageItems(&saveError{failed: 1, items: 30}))
+	// a failed page is skipped whole
+	assert.Equal(t, 100, w.pageItems(&pageError{err: errors.New("EOF"), class: errClassRetry}))
+}
+
+func TestBusy(t *testing.T) {
+	sch := newScheduler(1, &sliceSource{}, nil)
+	sch.createWorker(1)
+	assert.False(t, sch.busy())
+
+	sch.queue.push(job{})
+	assert.True(t, sch.busy())
+	assert.False(t, sch.startReplay())
+	sch.queue.clear()
+
+	sch.workers[0].status = statusRunning
+	assert.True(t, sch.busy())
+	sch.workers[0].status = statusStop
+
+	// one replay at a time, and no resume beside it
+	assert.True(t, sch.startReplay())
+	assert.True(t, sch.busy())
+	assert.False(t, sch.startReplay())
+	sch.endReplay()
+	assert.False(t, sch.busy())
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+	"github.com/golang/glog"
+)
+
+const (
+	selfBillUrl    = "https://itunes-api.performancehorizon.com/user/publisher/%s/selfbill"
+	selfBillCsvUrl = "https://itunes-api.performancehorizon.com/user/publisher/%s/selfbill/%s/items.csv"
+)
+
+type selfBillList struct {
+	SelfBills []struct {
+		SelfBill selfBill `json:"selfbill"`
+	} `json:"selfbills"`
+
+	Hypermedia struct {
+		Pagination pagination `json:"pagination"`
+	} `json:"hypermedia"`
+}
+
+type selfBill struct {
+	Reference  string  `json:"reference"`
+	Currency   string  `json:"currency"`
+	TotalValue float64 `json:"total_value"`
+	Status     string  `json:"status"`
+}
+
+// selfBillPoller creates applePayment rows for new self-bills of the accounts,
+// and hands the ready ones to the importer if autoImport is set
+type selfBillPoller struct {
+	interval   time.Duration
+	accounts   []*account
+	autoImport bool
+	ipt        *importer
+}
+
+func newSelfBillPoller(interval time.Duration, list []*account, autoImport bool, ipt *importer) *selfBillPoller {
+	p := &selfBillPoller{
+		interval:   interval,
+		accounts:   list,
+		autoImport: autoImport,
+		ipt:        ipt,
+	}
+	return p
+}
+
+func (p *selfBillPoller) Start() {
+	p.poll()
+
+	ticker := time.NewTicker(p.interval)
+	for range ticker.C {
+		p.poll()
+	}
+}
+
+func (p *selfBillPoller) poll() {
+	for _, a := range p.accounts {
+		num, err := p.discover(a)
+		if err != nil {
+			logErrorf("account=%s %v", a.Name, err)
+			continue
+		}
+		if num > 0 {
+			glog.Infof("account=%s found %d new self-bills", a.Name, num)
+		}
+	}
+
+	if p.autoImport {
+		err := p.enqueue()
+		if err != nil {
+			logError(err)
+		}
+	}
+}
+
+// discover saves the self-bills of the account which are not saved yet.
+// It returns the number of new ones
+func (p *selfBillPoller) discover(a *account) (int, error) {
+	var newNum int
+
+	list, err := fetchSelfBills(a)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, bill := range list {
+		_, err := findApplePaymentByReference(bill.Reference)
+		if err == nil {
+			continue
+		}
+		if err != orm.ErrNoRows {
+			return newNum, err
+		}
+
+		pay := applePayment{
+			AccountID:  a.ID,
+			Reference:  bill.Reference,
+			CsvFile:    fmt.Sprintf(selfBillCsvUrl, a.PublisherID, bill.Reference),
+			Imported:   notImported,
+			TotalValue: bill.TotalValue,
+		}
+		err = pay.insert()
+		if err != nil {
+			return newNum, err
+		}
+		newNum++
+	}
+
+	return newNum, nil
+}
+
+// enqueue adds payments to the importer once exchange rate and paid amount are filled in.
+// The importer skips the ones it has queued already
+func (p *selfBillPoller) enqueue() error {
+	list, err := findReadyApplePayments()
+	if err != nil {
+		return err
+	}
+
+	for _, pay := range list {
+		err = p.ipt.addJob(pay.ID)
+		if err != nil {
+			// queue is full, try next time
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchSelfBills lists all self-bills of the account, following next_page links
+func fetchSelfBills(a *account) ([]selfBill, error) {
+	var result []selfBill
+
+	url := fmt.Sprintf(selfBillUrl, a.PublisherID)
+	pageURL := url
+
+	for pageURL != "" {
+		var list selfBillList
+
+		c := NewReqeustConfig(nil, a.authHeader(), 60, nil, nil)
+		body, _, err := HTTPGet(pageURL, c)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(body, &list)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range list.SelfBills {
+			result = append(result, item.SelfBill)
+		}
+
+		pageURL = ""
+		if next := list.Hypermedia.Pagination.NextPage; next != "" {
+			pageURL, err = resolveLink(url, next)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
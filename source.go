@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+)
+
+// ConversionSource fetches one page of conversions for a job, until ctx is done.
+// The conversions are handed to fn one by one, the returned list has the
+// pagination only
+type ConversionSource interface {
+	FetchPage(ctx context.Context, j job, fn itemHandler) (*conversionList, error)
+}
+
+// phSource fetches conversions from the Performance Horizon reporting API,
+// with the credentials of the account of the job
+type phSource struct {
+	timeout uint16
+	// currencyUSD, currencyNative or currencyBoth
+	currency string
+	rates    exchangeRates
+	// the worker takes the token of the first request of a page, the source
+	// those of the others
+	limiter *rateLimiter
+}
+
+func newPHSource(currency string, rates exchangeRates, limiter *rateLimiter) *phSource {
+	return &phSource{
+		timeout:  90,
+		currency: currency,
+		rates:    rates,
+		limiter:  limiter,
+	}
+}
+
+func (s *phSource) FetchPage(ctx context.Context, j job, fn itemHandler) (*conversionList, error) {
+	switch s.currency {
+	case currencyNative:
+		return s.fetch(ctx, j, false, func(item *conversionItem) error {
+			item.currency = currencyNative
+			// an item without exchange rate is quarantined, not the page
+			item.convErr = convertToUSD(&item.ConvData, s.rates)
+			return fn(item)
+		})
+	case currencyBoth:
+		// keep only the local values of the page, then stream the USD page.
+		// The next_page link is for USD, fetch the same page by offset
+		origins := make(map[string]*convOrigin)
+		nativeJob := j
+		nativeJob.nextPage = ""
+		_, err := s.fetch(ctx, nativeJob, false, func(item *conversionItem) error {
+			origins[item.ConvData.ID] = originOf(&item.ConvData)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.limiter.WaitContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return s.fetch(ctx, j, true, func(item *conversionItem) error {
+			item.currency = currencyBoth
+			item.ConvData.Origin = origins[item.ConvData.ID]
+			return fn(item)
+		})
+	default:
+		return s.fetch(ctx, j, true, fn)
+	}
+}
+
+// fetch requests one page, in USD if convert is true, otherwise in local currency
+func (s *phSource) fetch(ctx context.Context, j job, convert bool, fn itemHandler) (*conversionList, error) {
+	var list *conversionList
+	var params map[string]string
+
+	if j.account == nil {
+		return nil, fmt.Errorf("job %s has no account", j.String())
+	}
+
+	pageURL := fmt.Sprintf(apiUrl, j.account.PublisherID)
+
+	if j.nextPage != "" {
+		// the next_page link carries its own query
+		u, err := resolveLink(pageURL, j.nextPage)
+		if err != nil {
+			return nil, err
+		}
+		pageURL = u
+	} else {
+		params = map[string]string{
+			"offset":     strconv.Itoa(j.offset),
+			"limit":      strconv.Itoa(j.limit),
+			"start_date": sourceTimeStr(j.from),
+			"end_date":   sourceTimeStr(j.to),
+		}
+		if convert {
+			params["convert_currency"] = "USD"
+		}
+	}
+
+	c := NewReqeustConfig(params, j.account.authHeader(), s.timeout, nil, nil)
+
+	_, err := HTTPGetStream(ctx, pageURL, c, func(body io.Reader) error {
+		var err error
+		list, err = decodeConversions(body, fn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// resolveLink makes an absolute URL from a next_page link, which the API
+// returns relative to its host
+func resolveLink(base, link string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+
+	return baseURL.ResolveReference(ref).String(), nil
+}
+
+// fileSource serves conversions from a json file in the same format as the API,
+// so the fetch pipeline can run without network access
+type fileSource struct {
+	path        string
+	conversions []conversionItem
+}
+
+func newFileSource(path string) (*fileSource, error) {
+	var list conversionList
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileSource{
+		path:        path,
+		conversions: list.Conversions,
+	}
+
+	return s, nil
+}
+
+func (s *fileSource) FetchPage(ctx context.Context, j job, fn itemHandler) (*conversionList, error) {
+	var list conversionList
+
+	matched := make([]conversionItem, 0, len(s.conversions))
+	for _, item := range s.conversions {
+		t, err := strToTimeForConv(item.ConvData.ConversionTime)
+		if err != nil {
+			return nil, err
+		}
+		if !t.Before(j.from) && t.Before(j.to) {
+			matched = append(matched, item)
+		}
+	}
+
+	start := j.offset
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := start + j.limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	for i := start; i < end; i++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		item := matched[i]
+		err := fn(&item)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	page := &list.Hypermedia.Pagination
+	page.PageItemCount = end - start
+	page.TotalItemCount = len(matched)
+	if j.limit > 0 {
+		page.CurrentPage = start/j.limit + 1
+		page.TotalPageCount = (len(matched) + j.limit - 1) / j.limit
+	}
+	if end < len(matched) {
+		page.NextPage = fmt.Sprintf("%s?offset=%d&limit=%d", s.path, end, j.limit)
+	}
+
+	return &list, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSource(t *testing.T) {
+	source, err := newFileSource("testdata/conversions.json")
+	assert.NoError(t, err)
+
+	fromTime, _ := strToTimeNoT("2017-02-13 00:00:00")
+	toTime, _ := strToTimeNoT("2017-02-14 00:00:00")
+	j := job{from: fromTime, to: toTime, offset: 0, limit: 2}
+
+	var items []conversionItem
+	collect := func(item *conversionItem) error {
+		items = append(items, *item)
+		return nil
+	}
+
+	list, err := source.FetchPage(context.Background(), j, collect)
+	assert.NoError(t, err)
+	assert.Len(t, items, 2)
+	assert.NotEmpty(t, list.Hypermedia.Pagination.NextPage)
+
+	j.offset = 4
+	items = nil
+	list, err = source.FetchPage(context.Background(), j, collect)
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.Empty(t, list.Hypermedia.Pagination.NextPage)
+
+	// only conversions inside [from, to) are served
+	j.offset = 0
+	j.to, _ = strToTimeNoT("2017-02-13 08:01:17")
+	items = nil
+	list, err = source.FetchPage(context.Background(), j, collect)
+	assert.NoError(t, err)
+	assert.Len(t, items, 2)
+	assert.Empty(t, list.Hypermedia.Pagination.NextPage)
+}
+
+func TestResolveLink(t *testing.T) {
+	u, err := resolveLink("https://itunes-api.performancehorizon.com/reporting/report_publisher/publisher/1010l19090/conversion",
+		"/reporting/report_publisher/publisher/1010l19090/conversion.json?offset=100&limit=100")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://itunes-api.performancehorizon.com/reporting/report_publisher/publisher/1010l19090/conversion.json?offset=100&limit=100", u)
+}
+
+func TestRawConversion(t *testing.T) {
+	source, err := newFileSource("testdata/conversions.json")
+	assert.NoError(t, err)
+
+	item := source.conversions[0]
+	assert.Equal(t, "1000l893029726001", item.ConvData.ID)
+	assert.Contains(t, string(item.raw), `"conversion_id": "1000l893029726001"`)
+}
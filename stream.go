@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// itemHandler takes one conversion as soon as it is decoded. An error stops
+// decoding the page
+type itemHandler func(item *conversionItem) error
+
+// streamError is returned when a page is not in the shape of conversionList
+type streamError struct {
+	msg string
+}
+
+func (e *streamError) Error() string {
+	return e.msg
+}
+
+// decodeConversions decodes a page element by element, so only one conversion
+// of the page is in memory at a time. The conversions are handed to fn, the
+// returned list has the hypermedia block only
+func decodeConversions(r io.Reader, fn itemHandler) (*conversionList, error) {
+	var list conversionList
+
+	dec := json.NewDecoder(r)
+	err := expectDelim(dec, '{')
+	if err != nil {
+		return nil, err
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, &streamError{fmt.Sprintf("unexpected %v in page", tok)}
+		}
+
+		switch key {
+		case "conversions":
+			err = decodeItems(dec, fn)
+		case "hypermedia":
+			err = dec.Decode(&list.Hypermedia)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = expectDelim(dec, '}')
+	if err != nil {
+		return nil, err
+	}
+
+	return &list, nil
+}
+
+func decodeItems(dec *json.Decoder, fn itemHandler) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		// "conversions": null
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return &streamError{fmt.Sprintf("conversions is %v, not an array", tok)}
+	}
+
+	for dec.More() {
+		var item conversionItem
+		err = dec.Decode(&item)
+		if err != nil {
+			return err
+		}
+		err = fn(&item)
+		if err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return &streamError{fmt.Sprintf("expect %v, got %v", delim, tok)}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeConversions(t *testing.T) {
+	f, err := os.Open("testdata/conversions.json")
+	assert.NoError(t, err)
+	defer f.Close()
+
+	var ids []string
+	list, err := decodeConversions(f, func(item *conversionItem) error {
+		ids = append(ids, item.ConvData.ID)
+		assert.Contains(t, string(item.raw), item.ConvData.ID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, ids, 5)
+	assert.Equal(t, "1000l893029726001", ids[0])
+	assert.Empty(t, list.Conversions)
+
+	// hypermedia after the conversions, unknown fields skipped
+	body := `{"count": 1, "conversions": [{"conversion_data": {"conversion_id": "1"}}],
+	"hypermedia": {"pagination": {"next_page": "/next", "total_item_count": 3}}}`
+	list, err = decodeConversions(strings.NewReader(body), func(item *conversionItem) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "/next", list.Hypermedia.Pagination.NextPage)
+	assert.Equal(t, 3, list.Hypermedia.Pagination.TotalItemCount)
+
+	list, err = decodeConversions(strings.NewReader(`{"conversions": null}`), nil)
+	assert.NoError(t, err)
+
+	// an error of fn stops decoding
+	var num int
+	stop := errors.New("stop")
+	_, err = decodeConversions(strings.NewReader(`{"conversions": [{}, {}, {}]}`), func(item *conversionItem) error {
+		num++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, num)
+
+	_, err = decodeConversions(strings.NewReader(`{"conversions": {}}`), nil)
+	assert.Equal(t, errClassDecode, classifyError(err))
+	_, err = decodeConversions(strings.NewReader(`[]`), nil)
+	assert.Equal(t, errClassDecode, classifyError(err))
+	_, err = decodeConversions(strings.NewReader(`{"conversions": [{"conversion_data": 1}]}`), nil)
+	assert.Equal(t, errClassDecode, classifyError(err))
+}
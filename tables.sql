@@ -4,9 +4,21 @@ CREATE TABLE `affi_conversion_raw` (
   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `conversion_id` char(32) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
-  PRIMARY KEY (`id`)
+  `conversion_time` timestamp NULL DEFAULT NULL,
+  `at` char(32) NOT NULL DEFAULT '' COMMENT 'advertiser token',
+  `currency_mode` char(8) NOT NULL DEFAULT '' COMMENT 'native: raw_data has local values, both: local values in origin',
+  `origin` varchar(255) NOT NULL DEFAULT '' COMMENT 'json of local currency and values',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `affi_conversion_raw_conversion_id_unique` (`conversion_id`),
+  KEY `affi_conversion_raw_time_index` (`conversion_time`)
 ) ENGINE=MyISAM AUTO_INCREMENT=1599423 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
 
+-- for an existing affi_conversion_raw
+ALTER TABLE `affi_conversion_raw` ADD UNIQUE KEY `affi_conversion_raw_conversion_id_unique` (`conversion_id`);
+ALTER TABLE `affi_conversion_raw` ADD `conversion_time` timestamp NULL DEFAULT NULL, ADD KEY `affi_conversion_raw_time_index` (`conversion_time`);
+ALTER TABLE `affi_conversion_raw` ADD `at` char(32) NOT NULL DEFAULT '' COMMENT 'advertiser token';
+ALTER TABLE `affi_conversion_raw` ADD `currency_mode` char(8) NOT NULL DEFAULT '' COMMENT 'native: raw_data has local values, both: local values in origin', ADD `origin` varchar(255) NOT NULL DEFAULT '' COMMENT 'json of local currency and values';
+
 CREATE TABLE `affi_conversion_201702` (
   `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
   `conversion_id` char(32) NOT NULL,
@@ -17,6 +29,7 @@ CREATE TABLE `affi_conversion_201702` (
   `conversion_status` char(15) NOT NULL,
   `conversion_value` decimal(10,2) NOT NULL COMMENT '用户给苹果的充值(美金)',
   `conversion_value_origin` decimal(10,4) NOT NULL DEFAULT '0.00' COMMENT '用户给苹果的充值(本地货币)',
+  `conversion_currency` char(6) NOT NULL DEFAULT '' COMMENT '用户充值的货币名称',
   `publisher_commission` decimal(10,2) NOT NULL COMMENT '广告佣金(美金)',
   `apple_payed_us` tinyint(3) unsigned NOT NULL DEFAULT '0' COMMENT '苹果是否已经打款给我们',
   `apple_amount` double NOT NULL DEFAULT '0.00' COMMENT '苹果给我们打款的金额(当地货币)',
@@ -30,6 +43,7 @@ CREATE TABLE `affi_conversion_201702` (
   `type` tinyint(3) unsigned NOT NULL DEFAULT '0' COMMENT '0: SDK, 1: Web',
   `at` char(32) NOT NULL DEFAULT '' COMMENT 'advertiser token',
   `in_app` tinyint(3) unsigned NOT NULL DEFAULT '1',
+  `tags` varchar(255) NOT NULL DEFAULT '' COMMENT 'json of extra tags in publisher_reference',
   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (`id`),
@@ -38,4 +52,127 @@ CREATE TABLE `affi_conversion_201702` (
   KEY `affi_conversion_app_id_index` (`app_id`),
   KEY `affi_conversion_day_index` (`pay_time_day`),
   KEY `affi_conversion_payment_flag` (`app_id`, `apple_payed_us`, `payed_user`)
-) ENGINE=InnoDB AUTO_INCREMENT=0 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
\ No newline at end of file
+) ENGINE=InnoDB AUTO_INCREMENT=0 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `affi_fetch_dead_letter` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `account_id` int(10) unsigned NOT NULL DEFAULT '0',
+  `from_time` datetime NOT NULL,
+  `to_time` datetime NOT NULL,
+  `offset` int(10) unsigned NOT NULL DEFAULT '0',
+  `page_limit` int(10) unsigned NOT NULL DEFAULT '0',
+  `error` varchar(1024) NOT NULL DEFAULT '',
+  `attempts` int(10) unsigned NOT NULL DEFAULT '0',
+  `replayed` tinyint(3) unsigned NOT NULL DEFAULT '0' COMMENT '0: pending, 1: replayed',
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `affi_fetch_dead_letter_replayed_index` (`replayed`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `affi_fetch_checkpoint` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `run` char(32) NOT NULL DEFAULT '',
+  `account_id` int(10) unsigned NOT NULL DEFAULT '0',
+  `from_time` datetime NOT NULL,
+  `to_time` datetime NOT NULL,
+  `offset` int(10) unsigned NOT NULL DEFAULT '0' COMMENT 'first page not saved yet',
+  `page_limit` int(10) unsigned NOT NULL DEFAULT '0',
+  `next_page` varchar(1024) NOT NULL DEFAULT '',
+  `last_conv_time` datetime NOT NULL,
+  `done` tinyint(3) unsigned NOT NULL DEFAULT '0' COMMENT '0: pending, 1: done',
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `affi_fetch_checkpoint_done_index` (`done`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `affi_publisher_account` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(64) NOT NULL,
+  `app_key` varchar(64) NOT NULL,
+  `api_key` varchar(64) NOT NULL,
+  `publisher_id` char(32) NOT NULL,
+  `at` char(32) NOT NULL DEFAULT '' COMMENT 'advertiser token',
+  `enabled` tinyint(3) unsigned NOT NULL DEFAULT '1',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `affi_publisher_account_name_unique` (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+ALTER TABLE `affi_sdk_apple_payment` ADD `account_id` int(10) unsigned NOT NULL DEFAULT '0' COMMENT '0: the first account';
+
+CREATE TABLE `affi_fetch_watermark` (
+  `account_id` int(10) unsigned NOT NULL,
+  `fetched_until` datetime NOT NULL COMMENT 'all conversions before it are fetched',
+  `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`account_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `affi_conversion_status_history` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `conversion_id` char(32) NOT NULL,
+  `conversion_time` timestamp NOT NULL,
+  `old_status` char(15) NOT NULL DEFAULT '',
+  `new_status` char(15) NOT NULL DEFAULT '',
+  `old_value` decimal(10,2) NOT NULL DEFAULT '0.00',
+  `new_value` decimal(10,2) NOT NULL DEFAULT '0.00',
+  `run` char(32) NOT NULL DEFAULT '' COMMENT 'fetch run which observed the change',
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `affi_conversion_status_history_conversion_id_index` (`conversion_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `affi_conversion_detail` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `conversion_id` char(32) NOT NULL,
+  `conversion_time` timestamp NOT NULL,
+  `campaign_id` char(32) NOT NULL DEFAULT '',
+  `currency` char(6) NOT NULL DEFAULT '',
+  `country` char(6) NOT NULL DEFAULT '',
+  `device` varchar(64) NOT NULL DEFAULT '',
+  `customer_type` varchar(32) NOT NULL DEFAULT '',
+  `referer_ip` varchar(64) NOT NULL DEFAULT '',
+  `source_referer` varchar(1024) NOT NULL DEFAULT '',
+  `click_type` varchar(32) NOT NULL DEFAULT '',
+  `click_status` varchar(32) NOT NULL DEFAULT '',
+  `click_time` varchar(32) NOT NULL DEFAULT '',
+  `click_ip` varchar(64) NOT NULL DEFAULT '',
+  `click_referer` varchar(1024) NOT NULL DEFAULT '',
+  `user_agent` varchar(1024) NOT NULL DEFAULT '',
+  `meta_data` text,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `affi_conversion_detail_conversion_id_unique` (`conversion_id`),
+  KEY `affi_conversion_detail_country_index` (`country`),
+  KEY `affi_conversion_detail_device_index` (`device`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- for each existing affi_conversion_YYYYMM
+ALTER TABLE `affi_conversion_201702` ADD `conversion_currency` char(6) NOT NULL DEFAULT '' COMMENT '用户充值的货币名称' AFTER `conversion_value_origin`;
+ALTER TABLE `affi_conversion_201702` ADD `tags` varchar(255) NOT NULL DEFAULT '' COMMENT 'json of extra tags in publisher_reference' AFTER `in_app`;
+
+CREATE TABLE `affi_exchange_rate` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `currency` char(6) NOT NULL,
+  `day` date NOT NULL,
+  `rate` double NOT NULL COMMENT '1 USD = rate currency',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `affi_exchange_rate_currency_day_unique` (`currency`, `day`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `affi_conversion_quarantine` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `conversion_id` char(32) NOT NULL,
+  `conversion_time` char(19) NOT NULL DEFAULT '',
+  `account_id` int(10) unsigned NOT NULL DEFAULT '0',
+  `publisher_reference` varchar(255) NOT NULL DEFAULT '' COMMENT 'can be fixed by hand before rerun',
+  `raw_data` blob NOT NULL,
+  `currency_mode` char(8) NOT NULL DEFAULT '' COMMENT 'native: raw_data has local values, both: local values in origin',
+  `origin` varchar(255) NOT NULL DEFAULT '' COMMENT 'json of local currency and values',
+  `error` varchar(1024) NOT NULL DEFAULT '',
+  `resolved` tinyint(3) unsigned NOT NULL DEFAULT '0' COMMENT '0: pending, 1: saved',
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `affi_conversion_quarantine_conversion_id_unique` (`conversion_id`),
+  KEY `affi_conversion_quarantine_resolved_index` (`resolved`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/astaxie/beego/orm"
+)
+
+const (
+	// times in the API, its csv files and the web API
+	sourceTimeFormat = "2006-01-02 15:04:05"
+	// times in mysql and the command line
+	reportTimeFormat = "2006-01-02T15:04:05"
+)
+
+var (
+	// timezone of the times the API returns and takes
+	sourceLoc = time.UTC
+	// timezone of the monthly tables, pay_time_day, the times saved to mysql
+	// and the dates given to the command line and the web API
+	reportLoc = time.UTC
+)
+
+// loadTimezones sets the source and report timezones by IANA name, like
+// America/Los_Angeles
+func loadTimezones(source, report string) error {
+	s, err := time.LoadLocation(source)
+	if err != nil {
+		return err
+	}
+	r, err := time.LoadLocation(report)
+	if err != nil {
+		return err
+	}
+
+	sourceLoc = s
+	reportLoc = r
+	// beego reads and writes datetime columns in this timezone
+	orm.DefaultTimeLoc = r
+	return nil
+}
+
+// sourceTimeStr formats t for the API
+func sourceTimeStr(t time.Time) string {
+	return t.In(sourceLoc).Format(sourceTimeFormat)
+}
+
+// reportTimeStr formats t for mysql and the command line
+func reportTimeStr(t time.Time) string {
+	return t.In(reportLoc).Format(reportTimeFormat)
+}
+
+// reportMonth is the month of t in the report timezone, like 201702
+func reportMonth(t time.Time) string {
+	return t.In(reportLoc).Format("200601")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimezones(t *testing.T) {
+	defer func() {
+		sourceLoc = time.UTC
+		reportLoc = time.UTC
+	}()
+
+	sourceLoc = time.FixedZone("PST", -8*3600)
+	reportLoc = time.FixedZone("CST", 8*3600)
+
+	// the last day of February in the API is March in the report timezone
+	data := conversionData{ID: "1", ConversionTime: "2017-02-28 10:30:00", PublisherRef: "u1024:com.example.game"}
+	c, err := data.toConversion("at")
+	assert.NoError(t, err)
+	assert.Equal(t, "affi_conversion_201703", c.TableName())
+	assert.Equal(t, 1, c.PayTimeDay)
+	assert.Equal(t, "2017-03-01T02:30:00", reportTimeStr(c.ConversionTime))
+	assert.Equal(t, "2017-02-28 10:30:00", sourceTimeStr(c.ConversionTime))
+
+	// dates of the command line and the web API are in the report timezone
+	from, err := strToTime("2017-03-01T00:00:00")
+	assert.NoError(t, err)
+	assert.Equal(t, "2017-02-28 08:00:00", sourceTimeStr(from))
+	to, err := strToTimeNoT("2017-04-01 00:00:00")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"affi_conversion_201703"}, convTableNames(from, to))
+
+	assert.Error(t, loadTimezones("UTC", "Nowhere/Unknown"))
+}
@@ -25,16 +25,24 @@ var (
 )
 
 type fetchInfo struct {
-	WorkerNum  int `json:"worker_num"`
-	Offset     int `json:"offset"`
-	FetchedNum int `json:"fetched_num"`
-	SavedNum   int `json:"saved_num"`
-	StopNum    int `json:"stop_num"`
+	WorkerNum  int          `json:"worker_num"`
+	Offset     int          `json:"offset"`
+	FetchedNum int          `json:"fetched_num"`
+	SavedNum   int          `json:"saved_num"`
+	TotalNum   int          `json:"total_num"`
+	StopNum    int          `json:"stop_num"`
+	Queued     int          `json:"queued"`
+	Limiter    limiterState `json:"limiter"`
 }
 
 type webJob struct {
 	FromDate string `form:"from_date"`
 	ToDate   string `form:"to_date"`
+	// optional account name, all loaded accounts by default
+	Account string `form:"account"`
+	// optional retry policy of this run
+	Retry      int `form:"retry"`
+	RetryDelay int `form:"retry_delay"` // in second
 }
 
 func (f *fetchInfo) String() string {
@@ -51,16 +59,32 @@ func startWeb() {
 
 	engine = echo.New()
 	engine.POST("/job/fetch", startFetching)
+	engine.POST("/job/cancel", cancelFetching)
+	engine.POST("/job/resume", resumeFetching)
+	engine.GET("/workers", getWorkers)
+	engine.POST("/workers", resizeWorkers)
 	engine.GET("/status", showStatus)
 	engine.POST("/job/import", importApplePaymentData)
 	engine.GET("/import/warning", getImporterErrors)
+	engine.GET("/deadletter", getDeadLetters)
+	engine.POST("/deadletter/replay", replayDeadLetterJobs)
+	engine.GET("/conversion/:id/history", getStatusHistory)
+	engine.GET("/report/revenue", getRevenue)
+	engine.GET("/quarantine", getQuarantines)
+	engine.POST("/quarantine/rerun", rerunQuarantineJobs)
+	engine.POST("/quarantine/:id", fixQuarantine)
 
 	log.Fatal(engine.Start(":7100"))
 }
 
 func initImporter() {
 	ipt = newImporter("/tmp")
-	go ipt.Start()
+	go ipt.Start(Scheduler.ctx)
+
+	if selfBillInterval > 0 {
+		poller := newSelfBillPoller(selfBillInterval, accounts, autoImport, ipt)
+		go poller.Start()
+	}
 }
 
 // POST recieve job
@@ -68,7 +92,7 @@ func startFetching(cxt echo.Context) error {
 	var job webJob
 	err := cxt.Bind(&job)
 	if err != nil {
-		glog.Error(err)
+		logError(err)
 		return err
 	}
 
@@ -96,11 +120,31 @@ func startFetching(cxt echo.Context) error {
 		}
 	}
 
-	jobs, err := seperateJobs(fromTime, toTime, jobNum)
+	list := accounts
+	if job.Account != "" {
+		a := findAccount(accounts, job.Account)
+		if a == nil {
+			return cxt.JSON(403, echo.Map{"error_code": 2, "message": "account not found"})
+		}
+		list = []*account{a}
+	}
+
+	jobs, err := sliceAccountJobs(list, fromTime, toTime, sliceSize)
 	if err != nil {
 		return cxt.JSON(403, echo.Map{"error_code": 2, "message": err})
 	}
 
+	policy := cliRetryPolicy()
+	if job.Retry > 0 {
+		policy.MaxAttempts = job.Retry
+	}
+	if job.RetryDelay > 0 {
+		policy.BaseDelay = time.Duration(job.RetryDelay) * time.Second
+	}
+	for i := range jobs {
+		jobs[i].retry = policy.withDefaults()
+	}
+
 	Scheduler.receiveJobs(jobs)
 	cxt.JSON(200, echo.Map{"error_code": 0})
 
@@ -155,3 +199,170 @@ func getImporterErrors(c echo.Context) error {
 	c.JSON(200, echo.Map{"error_code": 0, "data": list})
 	return nil
 }
+
+// GET failed pages, pending ones only unless all=1
+func getDeadLetters(c echo.Context) error {
+	c.Response().Header().Add("Access-Control-Allow-Origin", "*")
+
+	list, err := findDeadLetters(c.QueryParam("all") == "1")
+	if err != nil {
+		return c.JSON(500, echo.Map{"error_code": 3, "message": redactedError(err)})
+	}
+
+	return c.JSON(200, echo.Map{"error_code": 0, "data": list})
+}
+
+// POST replay pending failed pages in background
+func replayDeadLetterJobs(c echo.Context) error {
+	c.Response().Header().Add("Access-Control-Allow-Origin", "*")
+
+	if !Scheduler.startReplay() {
+		return c.JSON(403, echo.Map{"error_code": 1, "message": "scheduler is working"})
+	}
+
+	go func() {
+		defer Scheduler.endReplay()
+		num, err := Scheduler.replayDeadLetters()
+		if err != nil {
+			logError(err)
+		}
+		glog.Infof("replayed %d dead letters", num)
+	}()
+
+	return c.JSON(200, echo.Map{"error_code": 0})
+}
+
+// GET status changes of a conversion
+func getStatusHistory(c echo.Context) error {
+	c.Response().Header().Add("Access-Control-Allow-Origin", "*")
+
+	list, err := findStatusHistory(c.Param("id"))
+	if err != nil {
+		return c.JSON(500, echo.Map{"error_code": 3, "message": redactedError(err)})
+	}
+
+	return c.JSON(200, echo.Map{"error_code": 0, "data": list})
+}
+
+// GET revenue grouped by country or device, for example
+// /report/revenue?by=country&from_date=2017-02-01 00:00:00&to_date=2017-03-01 00:00:00
+func getRevenue(c echo.Context) error {
+	c.Response().Header().Add("Access-Control-Allow-Origin", "*")
+
+	fromTime, err := strToTimeNoT(c.QueryParam("from_date"))
+	if err != nil {
+		return c.JSON(403, echo.Map{"error_code": 2, "message": redactedError(err)})
+	}
+	toTime, err := strToTimeNoT(c.QueryParam("to_date"))
+	if err != nil {
+		return c.JSON(403, echo.Map{"error_code": 2, "message": redactedError(err)})
+	}
+
+	list, err := revenueBy(c.QueryParam("by"), fromTime, toTime)
+	if err != nil {
+		return c.JSON(403, echo.Map{"error_code": 2, "message": redactedError(err)})
+	}
+
+	return c.JSON(200, echo.Map{"error_code": 0, "data": list})
+}
+
+// GET conversions which can not be parsed, pending ones only unless all=1
+func getQuarantines(c echo.Context) error {
+	c.Response().Header().Add("Access-Control-Allow-Origin", "*")
+
+	list, err := findQuarantines(c.QueryParam("all") == "1")
+	if err != nil {
+		return c.JSON(500, echo.Map{"error_code": 3, "message": redactedError(err)})
+	}
+
+	return c.JSON(200, echo.Map{"error_code": 0, "data": list})
+}
+
+// POST fix publisher_reference of a quarantined conversion
+func fixQuarantine(c echo.Context) error {
+	c.Response().Header().Add("Access-Control-Allow-Origin", "*")
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(403, echo.Map{"error_code": 2, "message": redactedError(err)})
+	}
+
+	err = setQuarantineRef(c.Request().Context(), id, c.FormValue("publisher_reference"))
+	if err != nil {
+		return c.JSON(500, echo.Map{"error_code": 3, "message": redactedError(err)})
+	}
+
+	return c.JSON(200, echo.Map{"error_code": 0})
+}
+
+// POST save pending quarantined conversions again
+func rerunQuarantineJobs(c echo.Context) error {
+	c.Response().Header().Add("Access-Control-Allow-Origin", "*")
+
+	num, err := rerunQuarantines(c.Request().Context(), newDBRates())
+	if err != nil {
+		return c.JSON(500, echo.Map{"error_code": 3, "message": redactedError(err)})
+	}
+
+	return c.JSON(200, echo.Map{"error_code": 0, "data": echo.Map{"saved": num}})
+}
+
+// POST fetch the unfinished jobs of interrupted runs from their last checkpoint
+func resumeFetching(c echo.Context) error {
+	c.Response().Header().Add("Access-Control-Allow-Origin", "*")
+
+	if Scheduler.busy() {
+		return c.JSON(403, echo.Map{"error_code": 1, "message": "scheduler is working"})
+	}
+
+	num, err := Scheduler.resumeJobs()
+	if err != nil {
+		return c.JSON(500, echo.Map{"error_code": 3, "message": redactedError(err)})
+	}
+
+	return c.JSON(200, echo.Map{"error_code": 0, "data": echo.Map{"resumed": num}})
+}
+
+// GET the number of fetch workers
+func getWorkers(c echo.Context) error {
+	c.Response().Header().Add("Access-Control-Allow-Origin", "*")
+
+	return c.JSON(200, echo.Map{"error_code": 0, "data": echo.Map{"workers": Scheduler.size()}})
+}
+
+// POST grow or shrink the fetch workers to num. Running workers leave after
+// their current page
+func resizeWorkers(c echo.Context) error {
+	c.Response().Header().Add("Access-Control-Allow-Origin", "*")
+
+	num, err := strconv.Atoi(c.FormValue("num"))
+	if err != nil {
+		return c.JSON(403, echo.Map{"error_code": 2, "message": redactedError(err)})
+	}
+	err = Scheduler.resize(num)
+	if err != nil {
+		return c.JSON(403, echo.Map{"error_code": 2, "message": redactedError(err)})
+	}
+
+	return c.JSON(200, echo.Map{"error_code": 0, "data": echo.Map{"workers": Scheduler.size()}})
+}
+
+// POST cancel running fetch jobs, all of them or only the one of worker_id
+func cancelFetching(c echo.Context) error {
+	c.Response().Header().Add("Access-Control-Allow-Origin", "*")
+
+	if c.FormValue("worker_id") == "" {
+		num := Scheduler.cancelJobs()
+		return c.JSON(200, echo.Map{"error_code": 0, "data": echo.Map{"canceled": num}})
+	}
+
+	id, err := strconv.Atoi(c.FormValue("worker_id"))
+	if err != nil {
+		return c.JSON(403, echo.Map{"error_code": 2, "message": redactedError(err)})
+	}
+	if !Scheduler.cancelJob(id) {
+		return c.JSON(403, echo.Map{"error_code": 2, "message": "worker is not running"})
+	}
+
+	return c.JSON(200, echo.Map{"error_code": 0, "data": echo.Map{"canceled": 1}})
+}
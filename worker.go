@@ -1,23 +1,22 @@
 package main
 
 import (
-	"strings"
-	"time"
-
-	"fmt"
-
+	"context"
 	"encoding/json"
+	"time"
 
 	"flag"
 
 	"strconv"
-
-	"github.com/golang/glog"
+	"sync"
+	"sync/atomic"
 )
 
 var (
-	appKey = ""
-	apiKey = ""
+	appKey      = ""
+	apiKey      = ""
+	atoken      = ""
+	publisherID = ""
 
 	statusNames map[int]string
 )
@@ -26,45 +25,77 @@ const (
 	statusRunning = iota
 	statusStop
 	statusError
+	statusCanceled
+
+	// pause when the API throttles us without Retry-After
+	defaultRetryAfter = 10 * time.Second
+
+	// a job stops after this many dead-lettered pages in a row
+	maxFailedPages = 3
 
-	atoken      = "1001lpy5"
-	publisherID = "1010l19090"
-	apiUrl      = "https://%s@itunes-api.performancehorizon.com/reporting/report_publisher/publisher/%s/conversion"
+	apiUrl = "https://itunes-api.performancehorizon.com/reporting/report_publisher/publisher/%s/conversion"
 )
 
+// fetchWorker is owned by its goroutine, others read it through snapshot.
+// currJob, totalItemNum and lastErr are written under mutex, status under
+// mutex and the mutex of the scheduler, and the item numbers are atomic
 type fetchWorker struct {
 	id     int
+	mutex  sync.Mutex
 	status int
 	// fetched item number
-	fetechedItemNum int
-	savedItemNum    int
+	fetechedItemNum int64
+	savedItemNum    int64
+	// total item number of current job reported by the API
+	totalItemNum int
 	// job
 	currJob      job
+	lastPage     pagination
 	lastConvTime time.Time
-	// stop signal
-	stop chan struct{}
-	sch  *scheduler
+	// conversions of the page being fetched
+	page pageCount
+	// context of current job, owned by the scheduler
+	ctx     context.Context
+	cancel  context.CancelFunc
+	sch     *scheduler
+	source  ConversionSource
+	limiter *rateLimiter
+	retry   retryPolicy
+	lastErr error
+	// bounds of the page size, and the limit of the next page
+	pageSize  pageSize
+	nextLimit int
+	// leave the pool after the current page, under the mutex of the scheduler
+	retired bool
 }
 
 func init() {
-	flag.StringVar(&appKey, "appKey", "", "appKey of apple")
-	flag.StringVar(&apiKey, "apiKey", "", "apiKey of apple")
+	flag.StringVar(&appKey, "appKey", "", "appKey of apple, visible in ps, use "+envAppKey+" or -secrets instead")
+	flag.StringVar(&apiKey, "apiKey", "", "apiKey of apple, visible in ps, use "+envAPIKey+" or -secrets instead")
+	flag.StringVar(&publisherID, "publisherID", "1010l19090", "publisher ID of apple")
+	flag.StringVar(&atoken, "atoken", "1001lpy5", "advertiser token written to conversions")
 
 	statusNames = map[int]string{
-		statusStop:    "stop",
-		statusRunning: "running",
-		statusError:   "error",
+		statusStop:     "stop",
+		statusRunning:  "running",
+		statusError:    "error",
+		statusCanceled: "canceled",
 	}
 }
 
+// newFetchWorker takes the next worker id of sch, its mutex must be held
 func newFetchWorker(j job, sch *scheduler) *fetchWorker {
 	w := &fetchWorker{
 		id:           sch.workerID,
 		status:       statusStop,
 		currJob:      j,
-		stop:         make(chan struct{}, 1),
+		ctx:          sch.ctx,
 		sch:          sch,
-		lastConvTime: j.from,
+		source:       sch.source,
+		limiter:      sch.limiter,
+		retry:        sch.retryOf(j),
+		pageSize:     sch.pageSize,
+		lastConvTime: j.savedUntil(),
 	}
 
 	sch.workerID++
@@ -72,167 +103,408 @@ func newFetchWorker(j job, sch *scheduler) *fetchWorker {
 	return w
 }
 
-func (w *fetchWorker) statusName() string {
-	return statusNames[w.status]
+// workerSnapshot is the state of a worker at one moment, it is never
+// changed after it is taken
+type workerSnapshot struct {
+	ID      int
+	Status  int
+	Job     job
+	Fetched int
+	Saved   int
+	Total   int
+	Err     error
 }
 
-func (w *fetchWorker) getStatus() []string {
+func (w *fetchWorker) snapshot() workerSnapshot {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return workerSnapshot{
+		ID:      w.id,
+		Status:  w.status,
+		Job:     w.currJob,
+		Fetched: int(atomic.LoadInt64(&w.fetechedItemNum)),
+		Saved:   int(atomic.LoadInt64(&w.savedItemNum)),
+		Total:   w.totalItemNum,
+		Err:     w.lastErr,
+	}
+}
+
+func (s workerSnapshot) statusName() string {
+	return statusNames[s.Status]
+}
+
+// row is the line of the worker in the status table
+func (s workerSnapshot) row() []string {
 	return []string{
-		strconv.Itoa(w.id),
-		w.statusName(),
-		strconv.Itoa(w.currJob.offset),
-		strconv.Itoa(w.fetechedItemNum),
-		strconv.Itoa(w.savedItemNum),
-		w.currJob.String(),
+		strconv.Itoa(s.ID),
+		s.statusName(),
+		strconv.Itoa(s.Job.offset),
+		strconv.Itoa(s.Job.limit),
+		strconv.Itoa(s.Fetched),
+		strconv.Itoa(s.Saved),
+		strconv.Itoa(s.Total),
+		s.Job.String(),
 	}
 }
 
+// setJob moves the worker to j. Only the goroutine of the worker calls it
+func (w *fetchWorker) setJob(j job) {
+	w.mutex.Lock()
+	w.currJob = j
+	w.mutex.Unlock()
+}
+
+// Run fetches the current job, then the queued jobs of the scheduler until
+// there is none left
 func (w *fetchWorker) Run() {
-	w.status = statusRunning
 	for {
-		select {
-		case <-w.stop:
+		status, err := w.runJob()
+		if !w.sch.nextJob(w, status, err) {
 			return
-		default:
-			// do default
-			_, hasNext := w.doJob()
-			if hasNext {
-				w.currJob.offset += w.currJob.limit
-			} else {
-				w.stopWorker()
-			}
 		}
 	}
 }
 
-func (w *fetchWorker) stopWorker() {
-	w.stop <- struct{}{}
-	// change status
-	w.status = statusStop
-	err := w.sch.rescheduleJob()
-	if err != nil {
-		glog.Error(err)
-	}
-}
+// runJob fetches the pages of the current job, and returns the status and
+// error the worker stops with if no job is queued. The checkpoint of the job
+// stays before its first failed page, so a resume fetches it again. The job
+// stops after maxFailedPages failed pages in a row
+func (w *fetchWorker) runJob() (int, error) {
+	var failed bool
+	var failedInRow int
 
-func (w *fetchWorker) doJob() (error, bool) {
-	var err error
-	var body []byte
-	var retry = 3
-	var needRetry = true
+	for {
+		if w.ctx.Err() != nil {
+			// the job is canceled where it is, its pages are not fetched
+			w.sch.pageFailed(w.currJob)
+			return statusCanceled, w.ctx.Err()
+		}
 
-	for retry > 0 && needRetry {
-		body, err = w.fetchAppleAPI()
+		err, hasNext := w.doJob(w.ctx)
+		if err != nil && w.ctx.Err() != nil {
+			// canceled, not a failed page
+			continue
+		}
+		if err != nil && !w.skipFailedPage(err) {
+			// keep the job where it is
+			w.sch.pageFailed(w.currJob)
+			return statusError, err
+		}
 		if err != nil {
-			glog.Error(err)
-			retry--
+			failed = true
+			failedInRow++
+			if failedInRow >= maxFailedPages {
+				return statusError, err
+			}
 		} else {
-			needRetry = false
+			failedInRow = 0
+		}
+		if err == nil && hasNext && w.sch.splitJob(w.currJob, w.lastPage) {
+			// the rest is queued in two halves
+			return statusStop, nil
+		}
+		if !hasNext {
+			if !failed {
+				w.sch.jobDone(w.ctx, w.currJob)
+			}
+			return statusStop, nil
+		}
+		w.setJob(w.currJob.next(w.lastPage, w.pageItems(err)).withLimit(w.nextLimit))
+		if !failed {
+			w.sch.pageSaved(w.ctx, w.currJob, w.lastConvTime)
+		}
+		if w.sch.releaseJob(w, w.currJob) {
+			// the pool shrank, another worker goes on with the rest
+			return statusStop, nil
 		}
 	}
+}
+
+// pageCount counts the conversions of one page as they are saved
+type pageCount struct {
+	items   int
+	fetched int
+	saved   int
+	// saves which failed, the page is failed if there is any
+	failed int
+	// spent saving, it is not the time of the API
+	saveTime time.Duration
+}
 
+// doJob fetches and saves the current page. It tells if the job has more
+// pages, a page which can not be fetched is skipped by offset while the last
+// known total says there are more
+func (w *fetchWorker) doJob(ctx context.Context) (error, bool) {
+	list, err := w.fetchPage(ctx)
 	if err != nil {
-		// TODO log error job
-		glog.Error(w.currJob.String())
-		return err, true
+		logErrorf("%s %v", w.currJob.String(), err)
+		return err, w.totalItemNum == 0 || w.currJob.offset+w.currJob.limit < w.totalItemNum
 	}
 
-	err, hasNext := w.resolveConversions(body)
+	err, hasNext := w.finishPage(list)
 	if err != nil {
-		glog.Error(err)
+		logError(err)
 		return err, hasNext
 	}
 
 	return nil, hasNext
 }
 
-func (w *fetchWorker) fetchAppleAPI() ([]byte, error) {
-	var url, basicAuth string
-	params := map[string]string{
-		"convert_currency": "USD",
-		"offset":           strconv.Itoa(w.currJob.offset),
-		"limit":            strconv.Itoa(w.currJob.limit),
-		"start_date":       w.currJob.from.Format("2006-01-02 15:04:05"),
-		"end_date":         w.currJob.to.Format("2006-01-02 15:04:05"),
+// skipFailedPage saves the failed page to the dead letter table, so that it
+// can be replayed later. It returns false if the job should not go on: the
+// API rejects the credentials or the request itself, for example a wrong
+// publisher id, so the other pages would fail the same way
+func (w *fetchWorker) skipFailedPage(err error) bool {
+	if pageErr, ok := err.(*pageError); ok && (pageErr.class == errClassAuth || pageErr.class == errClassFatal) {
+		return false
+	}
+
+	d := newDeadLetter(w.currJob, err)
+	saveErr := d.insert(w.ctx)
+	if saveErr != nil {
+		logErrorf("save dead letter %s %v", w.currJob.String(), saveErr)
+		return false
+	}
+	w.sch.pageFailed(w.currJob)
+
+	if _, ok := err.(*saveError); !ok {
+		// the link of the failed page is unknown, go on by offset
+		w.lastPage = pagination{}
+	}
+	return true
+}
+
+// pageItems is the number of items of the current page, the next page starts
+// after them. A page which failed to be fetched is skipped whole
+func (w *fetchWorker) pageItems(err error) int {
+	if _, ok := err.(*saveError); err != nil && !ok {
+		return w.currJob.limit
 	}
+	return w.page.items
+}
+
+// fetchPage fetches the current page and saves its conversions as they are
+// decoded, retrying as the retry policy says. Conversions saved before a
+// failed attempt are saved again by the next one. The page size adapts to
+// how the API copes, see pageSize. It gives up at once when ctx is done
+func (w *fetchWorker) fetchPage(ctx context.Context) (*conversionList, error) {
+	var decodeRetried bool
+	policy := w.retry.withDefaults()
+	size := w.pageSize.withDefaults()
+
+	w.setJob(w.currJob.withLimit(size.clamp(w.currJob.limit)))
+	w.nextLimit = w.currJob.limit
 
-	c := NewReqeustConfig(params, nil, 90, nil, nil)
+	for attempt := 1; ; attempt++ {
+		err := w.limiter.WaitContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		w.page = pageCount{}
+		start := time.Now()
+		list, err := w.source.FetchPage(ctx, w.currJob, func(item *conversionItem) error {
+			saveStart := time.Now()
+			defer func() { w.page.saveTime += time.Since(saveStart) }()
+			return w.saveItem(ctx, item)
+		})
+		if err == nil {
+			w.nextLimit = size.afterPage(w.currJob.limit, w.page.items, time.Since(start)-w.page.saveTime)
+			return list, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		logError(err)
+		w.backOff(err)
+		// a smaller page of the same offset, the skipped items are in the next page
+		w.setJob(w.currJob.withLimit(size.afterError(w.currJob.limit, err)))
+		w.nextLimit = w.currJob.limit
+
+		class := classifyError(err)
+		switch class {
+		case errClassAuth, errClassFatal:
+			return nil, &pageError{err: err, class: class, attempts: attempt}
+		case errClassDecode:
+			if decodeRetried {
+				return nil, &pageError{err: err, class: class, attempts: attempt}
+			}
+			decodeRetried = true
+		}
 
-	basicAuth = fmt.Sprintf("%s:%s", appKey, apiKey)
-	url = fmt.Sprintf(apiUrl, basicAuth, publisherID)
+		if attempt >= policy.MaxAttempts {
+			return nil, &pageError{err: err, class: class, attempts: attempt}
+		}
+		err = sleepContext(ctx, policy.delay(attempt))
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// backOff pauses all workers when the API throttles us
+func (w *fetchWorker) backOff(err error) {
+	httpErr, ok := err.(*HTTPError)
+	if !ok || !httpErr.Throttled() {
+		return
+	}
 
-	body, _, err := HTTPGet(url, c)
+	d := httpErr.RetryAfter
+	if d <= 0 {
+		d = defaultRetryAfter
+	}
+	w.limiter.pause(d)
+}
+
+// saveItem saves one conversion of the current page as soon as it is decoded.
+// Errors are logged and counted, finishPage fails the page if any save
+// failed. Only a done ctx stops the page
+func (w *fetchWorker) saveItem(ctx context.Context, item *conversionItem) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	w.page.items++
+
+	err := item.saveRaw(ctx, w.currJob.account.Atoken)
 	if err != nil {
-		return nil, err
+		logError(err)
+		w.page.failed++
+	}
+
+	c, err := item.toConversion(w.currJob.account.Atoken)
+	if err != nil {
+		logError(err)
+		err = newQuarantine(item, w.currJob.account, err).upsert(ctx)
+		if err != nil {
+			logError(err)
+			w.page.failed++
+		}
+		return nil
+	}
+	w.lastConvTime = c.ConversionTime
+
+	w.page.fetched++
+	// insert to db
+	err = c.save(ctx, w.currJob.run)
+	if err != nil {
+		logError(err)
+		w.page.failed++
+		return nil
 	}
+	err = item.ConvData.toDetail(c.ConversionTime).upsert(ctx)
+	if err != nil {
+		logError(err)
+		w.page.failed++
+		return nil
+	}
+	w.page.saved++
 
-	return body, nil
+	return nil
 }
 
-func (w *fetchWorker) resolveConversions(body []byte) (error, bool) {
-	var list conversionList
+// finishPage counts the saved conversions of a fetched page and tells if
+// the job has more pages. It returns a saveError if some were not saved
+func (w *fetchWorker) finishPage(list *conversionList) (error, bool) {
 	var hasNext bool
 
-	err := json.Unmarshal(body, &list)
-	if err != nil {
-		return err, false
+	atomic.AddInt64(&w.fetechedItemNum, int64(w.page.fetched))
+	atomic.AddInt64(&w.savedItemNum, int64(w.page.saved))
+
+	page := list.Hypermedia.Pagination
+	w.lastPage = page
+	if page.TotalItemCount > 0 {
+		w.mutex.Lock()
+		w.totalItemNum = page.TotalItemCount
+		w.mutex.Unlock()
 	}
 
-	if list.Hypermedia.Pagination.NextPage != "" {
+	if page.NextPage != "" {
+		hasNext = true
+	} else if page.TotalItemCount > w.currJob.offset+w.page.items && w.page.items > 0 {
+		// no link, but the total says there is more
 		hasNext = true
 	}
 
-	if len(list.Conversions) == 0 {
+	if w.page.items == 0 {
 		// TODO log api error
-		glog.Error(w.currJob.String())
+		logError(w.currJob.String())
 	}
 
-	for _, item := range list.Conversions {
-		c, err := item.ConvData.toConversion()
-		if err != nil {
-			glog.Error(err)
-			continue
-		}
-		w.lastConvTime = c.ConversionTime
-
-		w.fetechedItemNum++
-		// insert to db
-		if c.ConversionValue > 0 {
-			conv, _ := findByConversionID(c.ConversionTime, c.ConversionID)
-			if conv == nil {
-				err = c.insert()
-				if err != nil {
-					glog.Error(err)
-					continue
-				}
-			} else {
-				if item.ConvData.Value.Status != c.ConversionStatus {
-					err = conv.update(item.ConvData.Value.Status, item.ConvData.Value.Value)
-					if err != nil {
-						glog.Error(err)
-						continue
-					}
-				}
-			}
-		}
-		w.savedItemNum++
+	if w.page.failed > 0 {
+		return &saveError{failed: w.page.failed, items: w.page.items}, hasNext
 	}
-
 	return nil, hasNext
 }
 
 type conversionList struct {
-	Conversions []struct {
-		ConvData conversionData `json:"conversion_data"`
-	} `json:"conversions"`
+	// empty when the page is decoded as a stream
+	Conversions []conversionItem `json:"conversions"`
 
 	Hypermedia struct {
-		Pagination struct {
-			NextPage string `json:"next_page"`
-		} `json:"pagination"`
+		Pagination pagination `json:"pagination"`
 	} `json:"hypermedia"`
 }
 
+type pagination struct {
+	NextPage       string `json:"next_page"`
+	CurrentPage    int    `json:"current_page"`
+	PageItemCount  int    `json:"page_item_count"`
+	TotalPageCount int    `json:"total_page_count"`
+	TotalItemCount int    `json:"total_item_count"`
+}
+
+type conversionItem struct {
+	ConvData conversionData `json:"conversion_data"`
+	// raw json of the item as the API returned it
+	raw []byte
+	// currency mode the item was fetched in, empty for usd. See restoreCurrency
+	currency string
+	// why the values can not be converted to USD, the item is quarantined
+	convErr error
+}
+
+func (c *conversionItem) UnmarshalJSON(b []byte) error {
+	// item has no UnmarshalJSON, so it does not recurse
+	type item conversionItem
+	var i item
+
+	err := json.Unmarshal(b, &i)
+	if err != nil {
+		return err
+	}
+
+	*c = conversionItem(i)
+	c.raw = append([]byte(nil), b...)
+	return nil
+}
+
+func (c *conversionItem) toConversion(at string) (*conversion, error) {
+	if c.convErr != nil {
+		return nil, c.convErr
+	}
+	return c.ConvData.toConversion(at)
+}
+
+func (c *conversionItem) saveRaw(ctx context.Context, at string) error {
+	t, err := strToTimeForConv(c.ConvData.ConversionTime)
+	if err != nil {
+		return err
+	}
+
+	raw := conversionRaw{
+		ConversionID:   c.ConvData.ID,
+		ConversionTime: t,
+		Atoken:         at,
+		RawData:        string(c.raw),
+		CurrencyMode:   c.currency,
+		Origin:         c.originJSON(),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	return raw.upsert(ctx)
+}
+
 type conversionData struct {
 	ID             string    `json:"conversion_id"`
 	ConversionTime string    `json:"conversion_time"`
@@ -240,6 +512,28 @@ type conversionData struct {
 	AdvRef         string    `json:"advertiser_reference"`
 	CustomerRef    string    `json:"customer_reference"`
 	Value          convValue `json:"conversion_value"`
+
+	CampaignID    string          `json:"campaign_id"`
+	Currency      string          `json:"currency"`
+	Country       string          `json:"country"`
+	Device        string          `json:"device"`
+	CustomerType  string          `json:"customer_type"`
+	RefererIP     string          `json:"referer_ip"`
+	SourceReferer string          `json:"source_referer"`
+	Click         convClick       `json:"click"`
+	MetaData      json.RawMessage `json:"meta_data"`
+
+	// local currency value, set when fetching in native or both currency mode
+	Origin *convOrigin `json:"-"`
+}
+
+type convClick struct {
+	Type      string `json:"type"`
+	Status    string `json:"status"`
+	SetTime   string `json:"set_time"`
+	SetIP     string `json:"set_ip"`
+	Referer   string `json:"referer"`
+	UserAgent string `json:"user_agent"`
 }
 
 type convValue struct {
@@ -248,43 +542,22 @@ type convValue struct {
 	PublisherCommission float32 `json:"publisher_commission"`
 }
 
-func (c *conversionData) toConversion() (*conversion, error) {
-	var uidStr, appID string
-	var typeVal, inApp byte
-	var uid int
-
+func (c *conversionData) toConversion(at string) (*conversion, error) {
 	t, err := strToTimeForConv(c.ConversionTime)
 	if err != nil {
 		return nil, err
 	}
 
-	info := strings.Split(c.PublisherRef, ":")
-	if len(info) >= 2 {
-		uidStr = info[0]
-		appID = info[1]
-	}
-	if strings.HasPrefix(uidStr, "u") {
-		uidStr = uidStr[1:]
-		typeVal = 0
-	} else {
-		typeVal = 1
-	}
-
-	uid, err = strconv.Atoi(uidStr)
+	info, err := refParser.parse(c.PublisherRef, c.AdvRef)
 	if err != nil {
-		glog.Errorf("convert uidStr %s to int failed", uidStr)
 		return nil, err
 	}
 
-	if strings.Contains(c.AdvRef, "In-App") {
-		inApp = 1
-	}
-
 	conv := conversion{
 		ConversionID:        c.ID,
 		ConversionTime:      t,
-		UID:                 uid,
-		AppID:               appID,
+		UID:                 info.UID,
+		AppID:               info.AppID,
 		CustomerRef:         c.CustomerRef,
 		ConversionStatus:    c.Value.Status,
 		ConversionValue:     c.Value.Value,
@@ -292,17 +565,24 @@ func (c *conversionData) toConversion() (*conversion, error) {
 		PayedUser:           0,
 		PayUserAmount:       c.Value.PublisherCommission * 0.05,
 		PayTime:             int(t.Unix()),
-		PayTimeDay:          t.Day(),
-		Atoken:              atoken,
-		Type:                typeVal,
-		InApp:               inApp,
+		PayTimeDay:          t.In(reportLoc).Day(),
+		Atoken:              at,
+		Type:                info.Type,
+		InApp:               info.InApp,
+		Tags:                info.tagsString(),
 		CreatedAt:           time.Now(),
 		UpdatedAt:           time.Now(),
 	}
 
+	if c.Origin != nil {
+		conv.ConversionValueOrigin = c.Origin.Value
+		conv.ConversionCurrency = c.Origin.Currency
+	}
+
 	return &conv, nil
 }
 
+// strToTimeForConv parses a time of the API in the source timezone
 func strToTimeForConv(timeStr string) (time.Time, error) {
-	return time.Parse("2006-01-02 15:04:05", timeStr)
+	return time.ParseInLocation(sourceTimeFormat, timeStr, sourceLoc)
 }
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,19 +22,205 @@ func TestWorker(t *testing.T) {
 	fmt.Println(end)
 
 	j := job{
-		from:   start,
-		to:     end,
-		offset: 0,
-		limit:  10,
+		from:    start,
+		to:      end,
+		offset:  0,
+		limit:   10,
+		account: flagAccount(),
 	}
 
 	worker := fetchWorker{
 		id:      1,
 		status:  statusRunning,
 		currJob: j,
+		source:  newPHSource(currencyUSD, nil, nil),
 	}
 
-	err, hasNext := worker.doJob()
+	err, hasNext := worker.doJob(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, true, hasNext)
 }
+
+type failingSource struct {
+	errs  []error
+	calls int
+	// limit of each call
+	limits []int
+}
+
+func (s *failingSource) FetchPage(ctx context.Context, j job, fn itemHandler) (*conversionList, error) {
+	s.calls++
+	s.limits = append(s.limits, j.limit)
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return nil, err
+	}
+	return &conversionList{}, nil
+}
+
+func TestFetchPageRetry(t *testing.T) {
+	policy := retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	// 5xx is retried until it succeeds
+	source := &failingSource{errs: []error{&HTTPError{StatusCode: 500}, &HTTPError{StatusCode: 502}}}
+	worker := fetchWorker{source: source, retry: policy}
+	_, err := worker.fetchPage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, source.calls)
+
+	// 4xx is not retried
+	source = &failingSource{errs: []error{&HTTPError{StatusCode: 404}}}
+	worker = fetchWorker{source: source, retry: policy}
+	_, err = worker.fetchPage(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 1, source.calls)
+	assert.Equal(t, errClassFatal, err.(*pageError).class)
+
+	// give up after max attempts
+	source = &failingSource{errs: []error{&HTTPError{StatusCode: 500}, &HTTPError{StatusCode: 500}, &HTTPError{StatusCode: 500}}}
+	worker = fetchWorker{source: source, retry: policy}
+	_, err = worker.fetchPage(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 3, err.(*pageError).attempts)
+}
+
+// itemSource serves pages of items until the offset reaches total
+type itemSource struct {
+	total int
+}
+
+func (s *itemSource) FetchPage(ctx context.Context, j job, fn itemHandler) (*conversionList, error) {
+	var list conversionList
+
+	for i := 0; i < j.limit && j.offset+i < s.total; i++ {
+		item := conversionItem{ConvData: conversionData{
+			ID:             fmt.Sprintf("%d-%d", j.from.Unix(), j.offset+i),
+			ConversionTime: sourceTimeStr(j.from),
+			PublisherRef:   "u1024:com.example.game",
+		}}
+		err := fn(&item)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	page := &list.Hypermedia.Pagination
+	page.TotalItemCount = s.total
+	if j.offset+j.limit < s.total {
+		page.NextPage = fmt.Sprintf("/conversion.json?offset=%d&limit=%d", j.offset+j.limit, j.limit)
+	}
+	return &list, nil
+}
+
+// TestWorkerRace reads the state of workers while they run, go test -race
+// tells if it is not synchronized
+func TestWorkerRace(t *testing.T) {
+	from := time.Date(2017, 2, 13, 0, 0, 0, 0, time.UTC)
+	a := &account{ID: 3, Name: "cn"}
+
+	useFakeDB(t, "fakedb")
+
+	sch := newScheduler(4, &itemSource{total: 250}, newRateLimiter(0, 1))
+	sch.pageSize = pageSize{Min: 50, Max: 100}
+	sch.createWorker(4)
+	jobs, err := sliceAccountJobs([]*account{a}, from, from.Add(6*time.Hour), time.Hour)
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		sch.receiveJobs(jobs)
+		sch.wait()
+		close(done)
+	}()
+
+	var info fetchInfo
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			sch.totalProcess(&info)
+			for _, s := range sch.snapshot() {
+				s.row()
+			}
+		}
+	}
+
+	sch.totalProcess(&info)
+	assert.Equal(t, 6*250, info.FetchedNum)
+	assert.Equal(t, 6*250, info.SavedNum)
+	assert.Equal(t, 0, info.Queued)
+	assert.Equal(t, 0, sch.failures(a.ID))
+	for _, s := range sch.snapshot() {
+		assert.Equal(t, statusStop, s.Status)
+	}
+}
+
+// TestWorkerSaveFailure fails every save, so no page is saved nor dead-lettered
+func TestWorkerSaveFailure(t *testing.T) {
+	from := time.Date(2017, 2, 13, 0, 0, 0, 0, time.UTC)
+	a := &account{ID: 3, Name: "cn"}
+
+	useFakeDB(t, "faileddb")
+	flag.Set("stderrthreshold", "FATAL")
+	defer flag.Set("stderrthreshold", "ERROR")
+
+	sch := newScheduler(2, &itemSource{total: 250}, nil)
+	sch.pageSize = pageSize{Min: 50, Max: 100}
+	sch.createWorker(2)
+	jobs, err := sliceAccountJobs([]*account{a}, from, from.Add(2*time.Hour), time.Hour)
+	assert.NoError(t, err)
+	sch.receiveJobs(jobs)
+	sch.wait()
+
+	// each job stops at its first page
+	assert.Equal(t, 2, sch.failures(a.ID))
+	for _, s := range sch.snapshot() {
+		assert.Equal(t, 0, s.Saved)
+		assert.Equal(t, statusError, s.Status)
+		assert.IsType(t, &saveError{}, s.Err)
+	}
+}
+
+// statusSource answers every page with the same http status
+type statusSource struct {
+	code  int
+	calls int32
+}
+
+func (s *statusSource) FetchPage(ctx context.Context, j job, fn itemHandler) (*conversionList, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return nil, &HTTPError{StatusCode: s.code}
+}
+
+func TestWorkerStopsFailing(t *testing.T) {
+	from := time.Date(2017, 2, 13, 0, 0, 0, 0, time.UTC)
+	a := &account{ID: 3, Name: "cn"}
+	useFakeDB(t, "fakedb")
+	flag.Set("stderrthreshold", "FATAL")
+	defer flag.Set("stderrthreshold", "ERROR")
+
+	// the API rejects the slice, it is given up at once without dead letter
+	source := &statusSource{code: 404}
+	sch := newScheduler(1, source, nil)
+	sch.createWorker(1)
+	sch.receiveJobs([]job{{from: from, to: from.Add(time.Hour), account: a, limit: 100}})
+	sch.wait()
+
+	assert.Equal(t, int32(1), source.calls)
+	assert.Equal(t, 1, sch.failures(a.ID))
+	assert.Equal(t, statusError, sch.snapshot()[0].Status)
+
+	// pages which keep failing are dead-lettered until too many fail in a row
+	source = &statusSource{code: 500}
+	sch = newScheduler(1, source, nil)
+	sch.retry = retryPolicy{MaxAttempts: 1}
+	sch.createWorker(1)
+	sch.receiveJobs([]job{{from: from, to: from.Add(time.Hour), account: a, limit: 100}})
+	sch.wait()
+
+	assert.Equal(t, int32(maxFailedPages), source.calls)
+	assert.Equal(t, maxFailedPages, sch.failures(a.ID))
+	assert.Equal(t, statusError, sch.snapshot()[0].Status)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// default length of the slices a range is cut into
+	defaultSliceSize = time.Hour
+	// a slice with more pages than this is cut in two, down to minSlice
+	splitPages = 10
+	minSlice   = 5 * time.Minute
+)
+
+// workQueue holds the slices not fetched yet, idle workers pull the next one.
+// It is guarded by the mutex of the scheduler
+type workQueue struct {
+	jobs []job
+}
+
+func (q *workQueue) push(jobs ...job) {
+	q.jobs = append(q.jobs, jobs...)
+}
+
+// pushFront queues jobs before all the others, for the halves of a slow slice
+func (q *workQueue) pushFront(jobs ...job) {
+	q.jobs = append(append([]job(nil), jobs...), q.jobs...)
+}
+
+func (q *workQueue) pop() (job, bool) {
+	if len(q.jobs) == 0 {
+		return job{}, false
+	}
+
+	j := q.jobs[0]
+	q.jobs = q.jobs[1:]
+	return j, true
+}
+
+func (q *workQueue) len() int {
+	return len(q.jobs)
+}
+
+// clear drops all queued slices and returns them
+func (q *workQueue) clear() []job {
+	jobs := q.jobs
+	q.jobs = nil
+	return jobs
+}
+
+// shouldSplit tells if the first page of j says the slice is too long for one
+// worker
+func shouldSplit(j job, p pagination) bool {
+	if j.offset != 0 || j.to.Sub(j.from) < 2*minSlice {
+		return false
+	}
+	return p.TotalItemCount > splitPages*j.limit
+}
+
+// sliceJobs cuts [fromTime, toTime) into equal slices no longer than size
+func sliceJobs(fromTime, toTime time.Time, size time.Duration) ([]job, error) {
+	if size <= 0 {
+		size = defaultSliceSize
+	}
+
+	num := int((toTime.Sub(fromTime) + size - 1) / size)
+	if num < 1 {
+		num = 1
+	}
+	return seperateJobs(fromTime, toTime, num)
+}
+
+// sliceAccountJobs cuts [fromTime, toTime) into slices no longer than size for
+// each account
+func sliceAccountJobs(list []*account, fromTime, toTime time.Time, size time.Duration) ([]job, error) {
+	result := make([]job, 0, len(list))
+	for _, a := range list {
+		jobs, err := sliceJobs(fromTime, toTime, size)
+		if err != nil {
+			return nil, err
+		}
+		for i := range jobs {
+			jobs[i].account = a
+		}
+		result = append(result, jobs...)
+	}
+
+	return result, nil
+}
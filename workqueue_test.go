@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSliceJobs(t *testing.T) {
+	fromTime, _ := strToTimeNoT("2017-02-13 00:00:00")
+	toTime, _ := strToTimeNoT("2017-02-13 02:30:00")
+
+	jobs, err := sliceJobs(fromTime, toTime, time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 3)
+	assert.Equal(t, fromTime, jobs[0].from)
+	assert.Equal(t, toTime, jobs[2].to)
+	assert.Equal(t, 50*time.Minute, jobs[0].to.Sub(jobs[0].from))
+
+	jobs, err = sliceJobs(fromTime, fromTime.Add(time.Minute), time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+
+	_, err = sliceJobs(fromTime, fromTime, time.Hour)
+	assert.Error(t, err)
+}
+
+func TestWorkQueue(t *testing.T) {
+	var q workQueue
+
+	q.push(job{offset: 1}, job{offset: 2})
+	q.pushFront(job{offset: 3})
+	assert.Equal(t, 3, q.len())
+
+	j, ok := q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, 3, j.offset)
+	j, _ = q.pop()
+	assert.Equal(t, 1, j.offset)
+
+	assert.Len(t, q.clear(), 1)
+	_, ok = q.pop()
+	assert.False(t, ok)
+}
+
+func TestShouldSplit(t *testing.T) {
+	from := time.Date(2017, 2, 13, 0, 0, 0, 0, time.UTC)
+	j := job{from: from, to: from.Add(time.Hour), limit: 100}
+
+	assert.True(t, shouldSplit(j, pagination{TotalItemCount: 1001}))
+	assert.False(t, shouldSplit(j, pagination{TotalItemCount: 1000}))
+
+	// only on the first page
+	j.offset = 100
+	assert.False(t, shouldSplit(j, pagination{TotalItemCount: 1001}))
+
+	// not below minSlice
+	j = job{from: from, to: from.Add(minSlice), limit: 100}
+	assert.False(t, shouldSplit(j, pagination{TotalItemCount: 1001}))
+}
+
+// sliceSource serves two empty pages for each slice, and says slices longer
+// than busySlice have many items
+type sliceSource struct {
+	mutex     sync.Mutex
+	busySlice time.Duration
+	// jobs of the last pages
+	done []job
+}
+
+func (s *sliceSource) FetchPage(ctx context.Context, j job, fn itemHandler) (*conversionList, error) {
+	var list conversionList
+
+	if j.offset == 0 {
+		list.Hypermedia.Pagination.NextPage = fmt.Sprintf("/conversion.json?offset=%d&limit=%d", j.limit, j.limit)
+		if j.to.Sub(j.from) > s.busySlice {
+			list.Hypermedia.Pagination.TotalItemCount = 100 * j.limit
+		}
+		return &list, nil
+	}
+
+	s.mutex.Lock()
+	s.done = append(s.done, j)
+	s.mutex.Unlock()
+	return &list, nil
+}
+
+func TestWorkQueueScheduler(t *testing.T) {
+	from := time.Date(2017, 2, 13, 0, 0, 0, 0, time.UTC)
+	a := &account{ID: 3, Name: "cn"}
+
+	// more jobs than workers
+	source := &sliceSource{busySlice: 24 * time.Hour}
+	sch := newScheduler(2, source, nil)
+	sch.createWorker(2)
+	jobs, err := sliceAccountJobs([]*account{a}, from, from.Add(10*time.Hour), time.Hour)
+	assert.NoError(t, err)
+	sch.receiveJobs(jobs)
+	sch.wait()
+
+	assert.Len(t, source.done, 10)
+	assert.Equal(t, 0, sch.queued())
+	for _, s := range sch.snapshot() {
+		assert.Equal(t, statusStop, s.Status)
+	}
+
+	// a busy hour is cut down to slices shorter than 2*minSlice
+	source = &sliceSource{busySlice: minSlice}
+	sch = newScheduler(3, source, nil)
+	sch.createWorker(3)
+	sch.receiveJobs([]job{{from: from, to: from.Add(time.Hour), account: a, limit: 100}})
+	sch.wait()
+
+	assert.Len(t, source.done, 8)
+	var covered time.Duration
+	for _, j := range source.done {
+		assert.Equal(t, 7*time.Minute+30*time.Second, j.to.Sub(j.from))
+		covered += j.to.Sub(j.from)
+	}
+	assert.Equal(t, time.Hour, covered)
+}